@@ -0,0 +1,316 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogCommon - denotes the common log format
+const AccessLogCommon = "common"
+
+// AccessLogCombined - denotes the combined log format
+const AccessLogCombined = "combined"
+
+// AccessLogJSON - denotes one json object per request
+const AccessLogJSON = "json"
+
+// RequestContextHandledBy - request context key, name of extension that
+// answered the request instead of the backend
+const RequestContextHandledBy = "cproxy.handled_by"
+
+// RequestContextUpstream - request context key, address of backend that
+// served the request
+const RequestContextUpstream = "cproxy.upstream"
+
+// accessLogPresets - format strings for preset formats
+var accessLogPresets = map[string]string{
+	AccessLogCommon:   `$remote_addr - - [$time_local] "$request" $status $body_bytes_sent`,
+	AccessLogCombined: `$remote_addr - - [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+}
+
+// accessLogVariable - matches variables in format strings
+var accessLogVariable = regexp.MustCompile(`\$[a-z_]+`)
+
+// AccessLogEntry - values logged for a completed request
+type AccessLogEntry struct {
+	RequestID   string  `json:"request_id"`
+	RemoteAddr  string  `json:"remote_addr"`
+	Time        string  `json:"time"`
+	Method      string  `json:"method"`
+	URI         string  `json:"uri"`
+	Protocol    string  `json:"protocol"`
+	Status      int     `json:"status"`
+	BytesSent   int64   `json:"body_bytes_sent"`
+	RequestTime float64 `json:"request_time"`
+	Referer     string  `json:"http_referer"`
+	UserAgent   string  `json:"http_user_agent"`
+	CacheStatus string  `json:"cache_status"`
+	HandledBy   string  `json:"handled_by"` // backend or extension name
+	Upstream    string  `json:"upstream_addr"`
+	start       time.Time
+}
+
+// AccessLog - writes one line per completed request
+type AccessLog struct {
+	path   string
+	format string
+	mutex  sync.Mutex
+	writer io.Writer
+	file   *os.File
+}
+
+// NewAccessLog - create access log from config, returns nil when disabled
+func NewAccessLog(config *AccessLogConfig) (*AccessLog, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	format := config.Format
+	if preset, ok := accessLogPresets[format]; ok {
+		format = preset
+	}
+	a := &AccessLog{
+		path:   config.Path,
+		format: format,
+	}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// NewAccessLogWithWriter - create access log writing to given writer
+func NewAccessLogWithWriter(writer io.Writer, format string) *AccessLog {
+	if preset, ok := accessLogPresets[format]; ok {
+		format = preset
+	}
+	return &AccessLog{format: format, writer: writer}
+}
+
+// Reopen - reopen log file, called on SIGHUP after the file was rotated
+func (a *AccessLog) Reopen() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.path == "stdout" {
+		a.writer = os.Stdout
+		return nil
+	}
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	a.writer = file
+	return nil
+}
+
+// Close - close log file
+func (a *AccessLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	a.writer = ioutil.Discard
+	return err
+}
+
+// Log - write entry for completed request
+func (a *AccessLog) Log(req *http.Request, w *ResponseWriter) {
+	entry := NewAccessLogEntry(req, w)
+	var line []byte
+	if a.format == AccessLogJSON {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = []byte(entry.format(a.format))
+	}
+	line = append(line, '\n')
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.writer.Write(line)
+}
+
+// NewAccessLogEntry - collect access log values for completed request
+func NewAccessLogEntry(req *http.Request, w *ResponseWriter) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		RemoteAddr:  req.RemoteAddr,
+		Method:      req.Method,
+		URI:         req.RequestURI,
+		Protocol:    req.Proto,
+		Status:      w.Status(),
+		BytesSent:   w.BytesWritten(),
+		Referer:     req.Referer(),
+		UserAgent:   req.UserAgent(),
+		CacheStatus: w.Header().Get(CacheStatusHeader),
+		HandledBy:   "backend",
+		start:       time.Now(),
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		entry.RemoteAddr = host
+	}
+	if entry.URI == "" {
+		entry.URI = req.URL.RequestURI()
+	}
+	if rc := GetRequestContext(req); rc != nil {
+		entry.RequestID = rc.ID
+		entry.start = rc.Start
+		entry.RequestTime = rc.Duration().Seconds()
+		if handledBy, ok := rc.Get(RequestContextHandledBy); ok {
+			entry.HandledBy = handledBy.(string)
+		}
+		if upstream, ok := rc.Get(RequestContextUpstream); ok {
+			entry.Upstream = upstream.(string)
+		}
+	}
+	entry.Time = entry.start.Format(time.RFC3339)
+	return entry
+}
+
+// validateAccessLogFormat - check format is a preset or a format string with
+// known variables
+func validateAccessLogFormat(format string) error {
+	if _, ok := accessLogPresets[format]; ok || format == AccessLogJSON {
+		return nil
+	}
+	names := accessLogVariable.FindAllString(format, -1)
+	if len(names) == 0 {
+		return fmt.Errorf("unknown access log format '%s', expected %s, %s, %s or a format string with $variables", format, AccessLogCommon, AccessLogCombined, AccessLogJSON)
+	}
+	values := (&AccessLogEntry{}).variables()
+	for _, name := range names {
+		if _, ok := values[name]; !ok {
+			return fmt.Errorf("unknown access log variable '%s'", name)
+		}
+	}
+	return nil
+}
+
+// format - replace variables in format string, unknown variables are kept
+func (e *AccessLogEntry) format(format string) string {
+	values := e.variables()
+	return accessLogVariable.ReplaceAllStringFunc(format, func(name string) string {
+		value, ok := values[name]
+		if !ok {
+			return name
+		}
+		if value == "" {
+			return "-"
+		}
+		return escapeAccessLogValue(value)
+	})
+}
+
+// variables - values of format string variables by name
+func (e *AccessLogEntry) variables() map[string]string {
+	return map[string]string{
+		"$remote_addr":     e.RemoteAddr,
+		"$time_local":      e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		"$time_iso8601":    e.Time,
+		"$request":         e.Method + " " + e.URI + " " + e.Protocol,
+		"$request_method":  e.Method,
+		"$request_uri":     e.URI,
+		"$status":          strconv.Itoa(e.Status),
+		"$body_bytes_sent": strconv.FormatInt(e.BytesSent, 10),
+		"$request_time":    strconv.FormatFloat(e.RequestTime, 'f', 3, 64),
+		"$http_referer":    e.Referer,
+		"$http_user_agent": e.UserAgent,
+		"$cache_status":    e.CacheStatus,
+		"$handled_by":      e.HandledBy,
+		"$upstream_addr":   e.Upstream,
+		"$request_id":      e.RequestID,
+	}
+}
+
+// escapeAccessLogValue - escape quotes and control characters
+func escapeAccessLogValue(value string) string {
+	b := strings.Builder{}
+	for _, c := range []byte(value) {
+		if c == '"' || c == '\\' || c < 0x20 || c >= 0x7f {
+			fmt.Fprintf(&b, `\x%02X`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// ResponseWriter - response writer that records status code and bytes written
+type ResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// NewResponseWriter - wrap response writer
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+// WriteHeader - record and write status code
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write - record and write body
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush - flush underlying writer when supported
+func (w *ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status - status code written, 200 if none was written
+func (w *ResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// BytesWritten - number of body bytes written
+func (w *ResponseWriter) BytesWritten() int64 {
+	return w.bytes
+}
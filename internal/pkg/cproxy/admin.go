@@ -0,0 +1,266 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// adminRedacted - value shown in place of secrets
+const adminRedacted = "[redacted]"
+
+// adminSecretKeys - config keys containing any of these are redacted
+var adminSecretKeys = []string{"token", "password", "passwd", "secret", "authorization", "api_key", "apikey", "credential", "private_key"}
+
+// startTime - time the proxy was started
+var startTime = time.Now()
+
+// AdminStatus - proxy runtime status
+type AdminStatus struct {
+	Name          string                   `json:"name"`
+	Version       int                      `json:"version"`
+	Started       time.Time                `json:"started"`
+	Uptime        string                   `json:"uptime"`
+	UptimeSeconds float64                  `json:"uptime_seconds"`
+	InFlight      int64                    `json:"in_flight"`
+	Counters      map[string][]MetricValue `json:"counters"`
+}
+
+// ExtensionInfo - loaded extension as reported by the admin api
+type ExtensionInfo struct {
+	Host           string   `json:"host,omitempty"` // names of virtual host extension belongs to
+	Position       int      `json:"position"`       // order extension events are called in
+	Name           string   `json:"name"`
+	Events         []string `json:"events"`
+	BufferResponse bool     `json:"buffer_response"`
+	Route          *int     `json:"route,omitempty"` // index of route with its own chain within its host
+}
+
+// NewAdminHandler - create handler for the admin listener, every endpoint
+// requires the admin token when one is configured
+func NewAdminHandler(runtime *Runtime) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, GetAdminStatus())
+	})
+	mux.HandleFunc("/extensions", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, GetHostExtensionInfo(runtime.Current().Hosts))
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		redacted, err := GetRedactedConfig(runtime.Current().Config)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, redacted)
+	})
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, GetBackendHealth())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MetricsContentType)
+		WriteMetrics(w)
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := runtime.Reload(); err != nil {
+			GetLogger().Error("config reload failed", "error", err)
+			writeAdminError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAdminJSON(w, map[string]string{"status": "reloaded"})
+	})
+	return adminAuth(runtime, mux)
+}
+
+// adminAuth - require bearer token of current config, no token leaves
+// handler unprotected
+func adminAuth(runtime *Runtime, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := runtime.Current().Config.Admin.Token
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+AppName+`"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetAdminStatus - get proxy runtime status
+func GetAdminStatus() AdminStatus {
+	uptime := time.Since(startTime)
+	return AdminStatus{
+		Name:          AppName,
+		Version:       VersionNo,
+		Started:       startTime,
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: uptime.Seconds(),
+		InFlight:      InFlightRequests(),
+		Counters:      GetCounters(),
+	}
+}
+
+// GetExtensionInfo - get loaded extensions in the order they are called
+func GetExtensionInfo(exts *[]Extension) []ExtensionInfo {
+	info := make([]ExtensionInfo, 0)
+	if exts == nil {
+		return info
+	}
+	for i, ext := range *exts {
+		events := make([]string, 0, 4)
+		if ext.OnRequest != nil {
+			events = append(events, "OnRequest")
+		}
+		if ext.OnResponse != nil {
+			events = append(events, "OnResponse")
+		}
+		if ext.OnError != nil {
+			events = append(events, "OnError")
+		}
+		if ext.OnUnload != nil {
+			events = append(events, "OnUnload")
+		}
+		info = append(info, ExtensionInfo{
+			Position:       i + 1,
+			Name:           ext.Name,
+			Events:         events,
+			BufferResponse: ext.BufferResponse,
+		})
+	}
+	return info
+}
+
+// GetHostExtensionInfo - get loaded extensions of every virtual host and of
+// routes with their own chain, the default host of a config without virtual
+// hosts has no names
+func GetHostExtensionInfo(hosts []*Host) []ExtensionInfo {
+	info := make([]ExtensionInfo, 0)
+	for _, host := range hosts {
+		for _, extInfo := range GetExtensionInfo(&host.Extensions) {
+			extInfo.Host = strings.Join(host.Names, ",")
+			info = append(info, extInfo)
+		}
+		for i, route := range host.Routes {
+			if !route.ownChain {
+				continue
+			}
+			index := i
+			for _, extInfo := range GetExtensionInfo(&route.Extensions) {
+				extInfo.Host = strings.Join(host.Names, ",")
+				extInfo.Route = &index
+				info = append(info, extInfo)
+			}
+		}
+	}
+	return info
+}
+
+// GetRedactedConfig - get effective config with secrets redacted, values of
+// secret looking keys, tracing headers and passwords in urls are replaced
+func GetRedactedConfig(config *Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	// tracing headers usually carry collector credentials, whatever their name
+	if tracing, ok := values["tracing"].(map[string]interface{}); ok {
+		if headers, ok := tracing["headers"].(map[string]interface{}); ok {
+			for name := range headers {
+				headers[name] = adminRedacted
+			}
+		}
+	}
+	return redactConfigValue(values).(map[string]interface{}), nil
+}
+
+// redactConfigValue - redact secrets in decoded json value
+func redactConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		{
+			for key, item := range v {
+				if isSecretConfigKey(key) && item != nil && item != "" {
+					v[key] = adminRedacted
+					continue
+				}
+				v[key] = redactConfigValue(item)
+			}
+			return v
+		}
+	case []interface{}:
+		{
+			for i, item := range v {
+				v[i] = redactConfigValue(item)
+			}
+			return v
+		}
+	case string:
+		{
+			if strings.Contains(v, "://") && strings.Contains(v, "@") {
+				if u, err := url.Parse(v); err == nil && u.User != nil {
+					return u.Redacted()
+				}
+			}
+			return v
+		}
+	}
+	return value
+}
+
+// isSecretConfigKey - determine if config key holds a secret
+func isSecretConfigKey(key string) bool {
+	// header style keys such as X-Api-Key match api_key
+	key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+	for _, secretKey := range adminSecretKeys {
+		if strings.Contains(key, secretKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAdminJSON - write value as json response
+func writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// writeAdminError - write error as json response with status code
+func writeAdminError(w http.ResponseWriter, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,313 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// BalancerRoundRobin - denotes weighted round robin balancing
+const BalancerRoundRobin = "round_robin"
+
+// BalancerLeastConn - denotes least connections balancing
+const BalancerLeastConn = "least_conn"
+
+// BalancerRandomTwo - denotes random two choices balancing
+const BalancerRandomTwo = "random_two"
+
+// BalancerHash - denotes consistent hashing on a header or cookie
+const BalancerHash = "hash"
+
+// hashRingReplicas - points on the hash ring per unit of weight
+const hashRingReplicas = 100
+
+// ErrNoBackend - returned when no backend is available
+var ErrNoBackend = errors.New("no backend available")
+
+// Backend - backend server, state is shared by every balancer using the address
+type Backend struct {
+	Address string
+	active  int64
+	health  backendHealth
+}
+
+// backends - backends by address
+var backends = make(map[string]*Backend)
+
+// backendsMutex - guards backends
+var backendsMutex sync.Mutex
+
+// getBackend - get shared backend for address
+func getBackend(address string) *Backend {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if backend, ok := backends[address]; ok {
+		return backend
+	}
+	backend := &Backend{Address: address}
+	backends[address] = backend
+	return backend
+}
+
+// ActiveConns - number of requests currently sent to backend
+func (b *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+// acquire - mark request started
+func (b *Backend) acquire() {
+	atomic.AddInt64(&b.active, 1)
+}
+
+// release - mark request finished
+func (b *Backend) release() {
+	atomic.AddInt64(&b.active, -1)
+}
+
+// balancerMember - backend and its weight in a balancer
+type balancerMember struct {
+	backend *Backend
+	weight  int
+	current int // smooth weighted round robin state
+}
+
+// hashRingPoint - point on the consistent hash ring
+type hashRingPoint struct {
+	hash   uint32
+	member *balancerMember
+}
+
+// balancer - selects a backend for each request
+type balancer struct {
+	config  BalancerConfig
+	members []*balancerMember
+	ring    []hashRingPoint
+	mutex   sync.Mutex
+}
+
+// balancers - balancers by configuration
+var balancers = make(map[string]*balancer)
+
+// balancersMutex - guards balancers
+var balancersMutex sync.Mutex
+
+// balancerKey - key of balancer for configured backends
+func balancerKey(config *Config) string {
+	key := config.Balancer.Strategy + "|" + config.Balancer.HashHeader + "|" + config.Balancer.HashCookie
+	for _, backendConfig := range config.GetBackends() {
+		key += "|" + backendConfig.Address + "=" + strconv.Itoa(backendConfig.Weight)
+	}
+	return key
+}
+
+// getBalancer - get shared balancer for configured backends
+func getBalancer(config *Config) *balancer {
+	backendConfigs := config.GetBackends()
+	key := balancerKey(config)
+	balancersMutex.Lock()
+	defer balancersMutex.Unlock()
+	if b, ok := balancers[key]; ok {
+		return b
+	}
+	b := &balancer{
+		config:  config.Balancer,
+		members: make([]*balancerMember, 0, len(backendConfigs)),
+	}
+	for _, backendConfig := range backendConfigs {
+		weight := backendConfig.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		member := &balancerMember{
+			backend: getBackend(backendConfig.Address),
+			weight:  weight,
+		}
+		b.members = append(b.members, member)
+		for i := 0; i < weight*hashRingReplicas; i++ {
+			b.ring = append(b.ring, hashRingPoint{
+				hash:   crc32.ChecksumIEEE([]byte(backendConfig.Address + "#" + strconv.Itoa(i))),
+				member: member,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+	balancers[key] = b
+	return b
+}
+
+// pruneBalancers - remove balancers and backends none of the configs use
+func pruneBalancers(configs []*Config) {
+	keys := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for _, config := range configs {
+		keys[balancerKey(config)] = true
+		for _, backendConfig := range config.GetBackends() {
+			addresses[backendConfig.Address] = true
+		}
+	}
+	balancersMutex.Lock()
+	for key := range balancers {
+		if !keys[key] {
+			delete(balancers, key)
+		}
+	}
+	balancersMutex.Unlock()
+	backendsMutex.Lock()
+	for address := range backends {
+		if !addresses[address] {
+			delete(backends, address)
+		}
+	}
+	backendsMutex.Unlock()
+}
+
+// SelectBackend - select backend for request, excluded backends are skipped
+func SelectBackend(req *http.Request, config *Config, exclude map[*Backend]bool) (*Backend, error) {
+	return getBalancer(config).pick(req, exclude)
+}
+
+// pick - pick backend using configured strategy, unhealthy backends are
+// skipped unless every backend is unhealthy
+func (b *balancer) pick(req *http.Request, exclude map[*Backend]bool) (*Backend, error) {
+	candidates := make([]*balancerMember, 0, len(b.members))
+	available := make([]*balancerMember, 0, len(b.members))
+	for _, member := range b.members {
+		if exclude[member.backend] {
+			continue
+		}
+		available = append(available, member)
+		if member.backend.Healthy() {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(available) == 0 {
+		return nil, ErrNoBackend
+	}
+	if len(candidates) == 0 {
+		// fail open, a possibly failing backend is better than none
+		candidates = available
+	}
+	if len(candidates) == 1 {
+		return candidates[0].backend, nil
+	}
+	switch b.config.Strategy {
+	case BalancerLeastConn:
+		{
+			return b.pickLeastConn(candidates), nil
+		}
+	case BalancerRandomTwo:
+		{
+			return b.pickRandomTwo(candidates), nil
+		}
+	case BalancerHash:
+		{
+			if member := b.pickHash(req, candidates); member != nil {
+				return member.backend, nil
+			}
+			break
+		}
+	}
+	return b.pickRoundRobin(candidates), nil
+}
+
+// pickRoundRobin - smooth weighted round robin
+func (b *balancer) pickRoundRobin(candidates []*balancerMember) *Backend {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	total := 0
+	var best *balancerMember
+	for _, member := range candidates {
+		member.current += member.weight
+		total += member.weight
+		if best == nil || member.current > best.current {
+			best = member
+		}
+	}
+	best.current -= total
+	return best.backend
+}
+
+// pickLeastConn - fewest active requests relative to weight
+func (b *balancer) pickLeastConn(candidates []*balancerMember) *Backend {
+	best := candidates[0]
+	for _, member := range candidates[1:] {
+		if member.load() < best.load() {
+			best = member
+		}
+	}
+	return best.backend
+}
+
+// pickRandomTwo - less loaded of two random backends
+func (b *balancer) pickRandomTwo(candidates []*balancerMember) *Backend {
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if candidates[j].load() < candidates[i].load() {
+		return candidates[j].backend
+	}
+	return candidates[i].backend
+}
+
+// pickHash - consistent hash on header or cookie, nil when request has no key
+func (b *balancer) pickHash(req *http.Request, candidates []*balancerMember) *balancerMember {
+	key := ""
+	if b.config.HashHeader != "" {
+		key = req.Header.Get(b.config.HashHeader)
+	}
+	if key == "" && b.config.HashCookie != "" {
+		if cookie, err := req.Cookie(b.config.HashCookie); err == nil {
+			key = cookie.Value
+		}
+	}
+	if key == "" || len(b.ring) == 0 {
+		return nil
+	}
+	allowed := make(map[*balancerMember]bool, len(candidates))
+	for _, member := range candidates {
+		allowed[member] = true
+	}
+	// walk ring clockwise to first allowed backend
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	for i := 0; i < len(b.ring); i++ {
+		point := b.ring[(start+i)%len(b.ring)]
+		if allowed[point.member] {
+			return point.member
+		}
+	}
+	return nil
+}
+
+// load - active requests relative to weight
+func (m *balancerMember) load() float64 {
+	return float64(m.backend.ActiveConns()) / float64(m.weight)
+}
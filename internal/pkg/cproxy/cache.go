@@ -0,0 +1,837 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheExtensionName - name of the built in cache extension
+const CacheExtensionName = "cache"
+
+// CacheStatusHeader - response header reporting cache status
+const CacheStatusHeader = "X-Cache"
+
+// cacheHeuristicStatusCodes - status codes that may be cached without explicit freshness
+var cacheHeuristicStatusCodes = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheStatusCodes - status codes understood by the cache
+var cacheStatusCodes = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 302: true, 307: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheHopByHopHeaders - headers that are never stored
+var cacheHopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", CacheStatusHeader,
+}
+
+// cacheMaxHeuristicLifetime - upper bound for heuristic freshness
+const cacheMaxHeuristicLifetime = 24 * time.Hour
+
+// cacheRefreshTimeout - time allowed for background refresh when no backend
+// timeout is configured
+const cacheRefreshTimeout = time.Minute
+
+// cacheRefreshStripHeaders - client headers not sent with background refresh,
+// the refresh fetches the full response and revalidates with the cache's own
+// validators
+var cacheRefreshStripHeaders = []string{
+	"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range", RequestIDHeader,
+}
+
+// cacheStaleErrorStatusCodes - backend status codes that stale-if-error applies to
+var cacheStaleErrorStatusCodes = map[int]bool{
+	500: true, 502: true, 503: true, 504: true,
+}
+
+// Cache - shared http cache following RFC 9111
+type Cache struct {
+	config             *CacheConfig
+	storage            CacheStorage
+	subRequestCallback SubRequestCallback // used for background refresh
+	refreshTimeout     time.Duration      // time allowed for background refresh
+	refreshing         sync.Map           // keys with a background refresh running
+}
+
+// cacheRefreshContextKey - marks background refresh requests in context.Context
+type cacheRefreshContextKey struct{}
+
+// cacheRequestContextKey - request context key for cache state
+const cacheRequestContextKey = "cproxy.cache"
+
+// cacheRequest - cache state for a request between OnRequest and OnResponse
+type cacheRequest struct {
+	key         string
+	requestTime time.Time
+	noStore     bool
+	invalidate  bool
+	entry       *cacheEntry
+	stale       *cacheEntry // stored response served if the backend fails
+	conditional http.Header // client conditional headers replaced while revalidating
+}
+
+// cacheEntryMeta - metadata stored with a cache entry
+type cacheEntryMeta struct {
+	RequestTime  time.Time `json:"request_time"`
+	ResponseTime time.Time `json:"response_time"`
+	Vary         []string  `json:"vary,omitempty"`
+	Variants     []string  `json:"variants,omitempty"`
+}
+
+// cacheEntry - stored response and metadata
+type cacheEntry struct {
+	meta cacheEntryMeta
+	resp *http.Response
+	body []byte
+}
+
+// NewCache - create cache with given storage, sub request callback is used
+// to refresh stale responses in the background and may be nil
+func NewCache(config *CacheConfig, storage CacheStorage, subRequestCallback SubRequestCallback) *Cache {
+	return &Cache{
+		config:             config,
+		storage:            storage,
+		subRequestCallback: subRequestCallback,
+		refreshTimeout:     cacheRefreshTimeout,
+	}
+}
+
+// NewCacheExtension - create the built in cache extension from config,
+// storage is shared with the cache of every other extension chain
+func NewCacheExtension(config *Config, subRequestCallback SubRequestCallback) (Extension, error) {
+	storage, release, err := acquireCacheStorage(&config.Cache)
+	if err != nil {
+		return Extension{}, err
+	}
+	cache := NewCache(&config.Cache, storage, subRequestCallback)
+	if config.Timeout > 0 {
+		cache.refreshTimeout = time.Duration(config.Timeout)
+	}
+	return Extension{
+		Name:       CacheExtensionName,
+		OnUnload:   release,
+		OnRequest:  cache.OnRequest,
+		OnResponse: cache.OnResponse,
+		OnError:    cache.OnError,
+	}, nil
+}
+
+// OnRequest - serve fresh responses from cache, prepare revalidation of stale ones
+func (c *Cache) OnRequest(req *http.Request) (*http.Response, error) {
+	cr := &cacheRequest{
+		key:         cacheKey(req),
+		requestTime: time.Now(),
+	}
+	// unsafe methods invalidate stored responses
+	if !isSafeMethod(req.Method) {
+		cr.invalidate = true
+		c.track(req, cr)
+		return nil, nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, nil
+	}
+	reqCC := parseCacheControl(req.Header)
+	_, cr.noStore = reqCC["no-store"]
+	entry, err := c.lookup(cr.key, req)
+	if err != nil && err != ErrCacheMiss {
+		RequestLogger(req).Warn("cache lookup failed", "error", err)
+	}
+	if entry != nil {
+		if c.usable(entry, reqCC, time.Now()) {
+			return c.serve(req, entry, req.Header, "HIT"), nil
+		}
+		// stale, client does not allow the backend to be contacted
+		if _, ok := reqCC["only-if-cached"]; ok {
+			return c.gatewayTimeout(req), nil
+		}
+		// stale, serve while a background fetch refreshes it unless
+		// client asked for a fresh response
+		_, noCache := reqCC["no-cache"]
+		_, maxAge := reqCC["max-age"]
+		if !noCache && !maxAge && c.subRequestCallback != nil && req.Context().Value(cacheRefreshContextKey{}) == nil &&
+			c.staleAllowed(entry, "stale-while-revalidate", c.config.StaleWhileRevalidate, time.Now()) {
+			c.refresh(req, cr.key)
+			return c.serve(req, entry, req.Header, "STALE"), nil
+		}
+		cr.stale = entry
+		// stale, revalidate with backend if response has validators
+		etag := entry.resp.Header.Get("ETag")
+		lastModified := entry.resp.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			cr.entry = entry
+			cr.conditional = http.Header{}
+			for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+				if values, ok := req.Header[name]; ok {
+					cr.conditional[name] = values
+				}
+				req.Header.Del(name)
+			}
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+	if _, ok := reqCC["only-if-cached"]; ok {
+		return c.gatewayTimeout(req), nil
+	}
+	c.track(req, cr)
+	return nil, nil
+}
+
+// OnResponse - store cacheable responses, complete revalidation
+func (c *Cache) OnResponse(resp *http.Response) (*http.Response, error) {
+	cr := c.untrack(resp.Request)
+	if cr == nil {
+		return resp, nil
+	}
+	req := resp.Request
+	// invalidate after successful unsafe request
+	if cr.invalidate {
+		if resp.StatusCode < 400 {
+			c.invalidate(cr.key, req, resp)
+		}
+		return resp, nil
+	}
+	cr.restoreConditional(req)
+	// backend failed, serve stale response instead
+	if cacheStaleErrorStatusCodes[resp.StatusCode] && cr.stale != nil &&
+		c.staleAllowed(cr.stale, "stale-if-error", c.config.StaleIfError, time.Now()) {
+		resp.Body.Close()
+		return c.serve(req, cr.stale, req.Header, "STALE"), nil
+	}
+	// revalidated, freshen stored response
+	if resp.StatusCode == http.StatusNotModified && cr.entry != nil {
+		resp.Body.Close()
+		entry := cr.entry
+		for name, values := range resp.Header {
+			if name == "Content-Length" || name == "Content-Type" {
+				continue
+			}
+			entry.resp.Header[name] = values
+		}
+		entry.meta.RequestTime = cr.requestTime
+		entry.meta.ResponseTime = time.Now()
+		if err := c.store(cr.key, req, entry.resp, entry.body, entry.meta); err != nil {
+			RequestLogger(req).Warn("cache store failed", "error", err)
+		}
+		return c.serve(req, entry, req.Header, "REVALIDATED"), nil
+	}
+	resp.Header.Set(CacheStatusHeader, "MISS")
+	if cr.noStore || !c.storable(req, resp) {
+		return resp, nil
+	}
+	// store body as it is read by the client
+	header := resp.Header.Clone()
+	meta := cacheEntryMeta{
+		RequestTime:  cr.requestTime,
+		ResponseTime: time.Now(),
+	}
+	stored := &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	resp.Body = &cacheBodyReader{
+		ReadCloser: resp.Body,
+		limit:      c.config.MaxEntrySize,
+		done: func(body []byte) {
+			if err := c.store(cr.key, req, stored, body, meta); err != nil {
+				GetLogger().Warn("cache store failed", "key", cr.key, "error", err)
+			}
+		},
+	}
+	return resp, nil
+}
+
+// OnError - serve stale response when the backend could not be reached
+func (c *Cache) OnError(req *http.Request, err error) (*http.Response, error) {
+	cr := c.untrack(req)
+	if cr == nil {
+		return nil, nil
+	}
+	cr.restoreConditional(req)
+	if cr.stale != nil && c.staleAllowed(cr.stale, "stale-if-error", c.config.StaleIfError, time.Now()) {
+		RequestLogger(req).Info("serve stale response", "key", cr.key, "error", err)
+		return c.serve(req, cr.stale, req.Header, "STALE"), nil
+	}
+	return nil, nil
+}
+
+// refresh - fetch request in the background through the sub request callback
+// so the extension chain runs and the response is stored, only one refresh
+// runs per key
+func (c *Cache) refresh(req *http.Request, key string) {
+	if _, running := c.refreshing.LoadOrStore(key, true); running {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), cacheRefreshContextKey{}, true), c.refreshTimeout)
+	refreshReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL.String(), nil)
+	if err != nil {
+		cancel()
+		c.refreshing.Delete(key)
+		RequestLogger(req).Warn("cache refresh failed", "key", key, "error", err)
+		return
+	}
+	refreshReq.Header = req.Header.Clone()
+	for _, name := range cacheRefreshStripHeaders {
+		refreshReq.Header.Del(name)
+	}
+	refreshReq.Host = req.Host
+	go func() {
+		defer c.refreshing.Delete(key)
+		defer cancel()
+		GetLogger().Debug("cache refresh", "key", key)
+		resp, err := c.subRequestCallback(refreshReq)
+		if err != nil {
+			GetLogger().Warn("cache refresh failed", "key", key, "error", err)
+			return
+		}
+		// body is stored once fully read
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// restoreConditional - restore client conditional headers replaced while revalidating
+func (cr *cacheRequest) restoreConditional(req *http.Request) {
+	if cr.conditional == nil {
+		return
+	}
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	for name, values := range cr.conditional {
+		req.Header[name] = values
+	}
+	cr.conditional = nil
+}
+
+// track - remember cache state on request context until response
+func (c *Cache) track(req *http.Request, cr *cacheRequest) {
+	if rc := GetRequestContext(req); rc != nil {
+		rc.Set(cacheRequestContextKey, cr)
+	}
+}
+
+// untrack - retrieve and forget cache state for request
+func (c *Cache) untrack(req *http.Request) *cacheRequest {
+	rc := GetRequestContext(req)
+	if rc == nil {
+		return nil
+	}
+	cr, ok := rc.Get(cacheRequestContextKey)
+	if !ok {
+		return nil
+	}
+	rc.Delete(cacheRequestContextKey)
+	return cr.(*cacheRequest)
+}
+
+// lookup - find stored response matching request
+func (c *Cache) lookup(key string, req *http.Request) (*cacheEntry, error) {
+	entry, err := c.load(key)
+	if err != nil {
+		return nil, err
+	}
+	// primary entry lists vary headers, variant is stored under secondary key
+	if entry.resp == nil {
+		return c.load(cacheVaryKey(key, entry.meta.Vary, req.Header))
+	}
+	return entry, nil
+}
+
+// load - load and decode entry from storage
+func (c *Cache) load(key string) (*cacheEntry, error) {
+	data, err := c.storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCacheEntry(data)
+}
+
+// store - encode and save entry to storage
+func (c *Cache) store(key string, req *http.Request, resp *http.Response, body []byte, meta cacheEntryMeta) error {
+	vary := cacheVaryHeaders(resp.Header)
+	if len(vary) > 0 {
+		// primary entry records vary headers and variant keys so
+		// invalidation can remove every variant
+		variant := cacheVaryKey(key, vary, req.Header)
+		primary := cacheEntryMeta{Vary: vary, Variants: []string{variant}}
+		if current, err := c.load(key); err == nil && current.resp == nil {
+			if strings.Join(current.meta.Vary, ",") == strings.Join(vary, ",") {
+				for _, name := range current.meta.Variants {
+					if name != variant {
+						primary.Variants = append(primary.Variants, name)
+					}
+				}
+			} else {
+				// vary headers changed, old variants can no longer be looked up
+				for _, name := range current.meta.Variants {
+					c.storage.Delete(name)
+				}
+			}
+		}
+		varyData, err := encodeCacheEntry(primary, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := c.storage.Set(key, varyData); err != nil {
+			return err
+		}
+		key = variant
+	}
+	data, err := encodeCacheEntry(meta, resp, body)
+	if err != nil {
+		return err
+	}
+	return c.storage.Set(key, data)
+}
+
+// invalidate - remove stored responses for request target and location
+func (c *Cache) invalidate(key string, req *http.Request, resp *http.Response) {
+	c.remove(key)
+	for _, name := range []string{"Location", "Content-Location"} {
+		location := resp.Header.Get(name)
+		if location == "" {
+			continue
+		}
+		u, err := url.Parse(location)
+		if err != nil || (u.Host != "" && u.Host != req.Host) {
+			continue
+		}
+		c.remove(req.Host + u.RequestURI())
+	}
+}
+
+// remove - delete stored response and its vary variants
+func (c *Cache) remove(key string) {
+	if entry, err := c.load(key); err == nil && entry.resp == nil {
+		for _, name := range entry.meta.Variants {
+			c.storage.Delete(name)
+		}
+	}
+	c.storage.Delete(key)
+}
+
+// usable - determine if stored response can be served without revalidation
+func (c *Cache) usable(entry *cacheEntry, reqCC map[string]string, now time.Time) bool {
+	respCC := parseCacheControl(entry.resp.Header)
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	age := entry.currentAge(now)
+	lifetime := entry.freshnessLifetime()
+	if maxAge, ok := cacheDirectiveSeconds(reqCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := cacheDirectiveSeconds(reqCC, "min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+	// stale, allowed only when client accepts stale responses
+	if maxStale, ok := reqCC["max-stale"]; ok && !entry.mustRevalidate() {
+		if maxStale == "" {
+			return true
+		}
+		limit, ok := cacheDirectiveSeconds(reqCC, "max-stale")
+		return ok && age-lifetime <= limit
+	}
+	return false
+}
+
+// staleAllowed - determine if stale entry may be served under stale-while-revalidate
+// or stale-if-error, window from config applies when response has no directive
+func (c *Cache) staleAllowed(entry *cacheEntry, directive string, window Duration, now time.Time) bool {
+	respCC := parseCacheControl(entry.resp.Header)
+	limit, ok := cacheDirectiveSeconds(respCC, directive)
+	if !ok {
+		if _, noCache := respCC["no-cache"]; noCache || entry.mustRevalidate() {
+			return false
+		}
+		limit = time.Duration(window)
+	}
+	return entry.currentAge(now)-entry.freshnessLifetime() <= limit
+}
+
+// storable - determine if response may be stored
+func (c *Cache) storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheStatusCodes[resp.StatusCode] {
+		return false
+	}
+	if c.config.MaxEntrySize > 0 && resp.ContentLength > c.config.MaxEntrySize {
+		return false
+	}
+	if !isSharedResponse(req, resp) {
+		return false
+	}
+	if hasSharedFreshness(resp) || resp.Header.Get("Expires") != "" {
+		return true
+	}
+	return cacheHeuristicStatusCodes[resp.StatusCode] && resp.Header.Get("Last-Modified") != ""
+}
+
+// isSharedResponse - determine if response to request may be given to other
+// clients by a shared cache
+func isSharedResponse(req *http.Request, resp *http.Response) bool {
+	respCC := parseCacheControl(resp.Header)
+	if _, ok := respCC["no-store"]; ok {
+		return false
+	}
+	if _, ok := respCC["private"]; ok {
+		return false
+	}
+	for _, name := range cacheVaryHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	// cookies are never shared between clients
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	_, mustRevalidate := respCC["must-revalidate"]
+	if req.Header.Get("Authorization") != "" && !hasSharedFreshness(resp) && !mustRevalidate {
+		return false
+	}
+	return true
+}
+
+// hasSharedFreshness - determine if response is explicitly marked for
+// storage by shared caches with public, s-maxage or max-age
+func hasSharedFreshness(resp *http.Response) bool {
+	respCC := parseCacheControl(resp.Header)
+	_, public := respCC["public"]
+	_, sMaxAge := respCC["s-maxage"]
+	_, maxAge := respCC["max-age"]
+	return public || sMaxAge || maxAge
+}
+
+// serve - create response from stored entry
+func (c *Cache) serve(req *http.Request, entry *cacheEntry, conditional http.Header, status string) *http.Response {
+	header := entry.resp.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(entry.currentAge(time.Now())/time.Second), 10))
+	header.Set(CacheStatusHeader, status)
+	resp := &http.Response{
+		Status:        entry.resp.Status,
+		StatusCode:    entry.resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Request:       req,
+		ContentLength: int64(len(entry.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.body)),
+	}
+	if cacheNotModified(conditional, header) {
+		resp.Status = "304 Not Modified"
+		resp.StatusCode = http.StatusNotModified
+		resp.ContentLength = 0
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		header.Del("Content-Length")
+	}
+	return resp
+}
+
+// gatewayTimeout - response for only-if-cached requests that cannot be served
+func (c *Cache) gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 Gateway Timeout",
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{CacheStatusHeader: []string{"MISS"}},
+		Request:    req,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+}
+
+// currentAge - age of stored response (RFC 9111 4.2.3)
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.resp.Header.Get("Date")); err == nil {
+		apparentAge = e.meta.ResponseTime.Sub(date)
+		if apparentAge < 0 {
+			apparentAge = 0
+		}
+	}
+	ageValue := time.Duration(0)
+	if age, err := strconv.ParseInt(e.resp.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+	correctedAge := ageValue + e.meta.ResponseTime.Sub(e.meta.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.meta.ResponseTime)
+}
+
+// freshnessLifetime - freshness lifetime of stored response (RFC 9111 4.2.1)
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	respCC := parseCacheControl(e.resp.Header)
+	if sMaxAge, ok := cacheDirectiveSeconds(respCC, "s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := cacheDirectiveSeconds(respCC, "max-age"); ok {
+		return maxAge
+	}
+	date, err := http.ParseTime(e.resp.Header.Get("Date"))
+	if err != nil {
+		date = e.meta.ResponseTime
+	}
+	if expiresValue := e.resp.Header.Get("Expires"); expiresValue != "" {
+		// invalid expires means already expired
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	// heuristic freshness, ten percent of time since last modified
+	if lastModified, err := http.ParseTime(e.resp.Header.Get("Last-Modified")); err == nil && cacheHeuristicStatusCodes[e.resp.StatusCode] {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > cacheMaxHeuristicLifetime {
+			lifetime = cacheMaxHeuristicLifetime
+		}
+		if lifetime > 0 {
+			return lifetime
+		}
+	}
+	return 0
+}
+
+// mustRevalidate - stale response must not be served without revalidation
+func (e *cacheEntry) mustRevalidate() bool {
+	respCC := parseCacheControl(e.resp.Header)
+	for _, name := range []string{"must-revalidate", "proxy-revalidate", "s-maxage"} {
+		if _, ok := respCC[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCacheEntry - encode entry as metadata line followed by response
+func encodeCacheEntry(meta cacheEntryMeta, resp *http.Response, body []byte) ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+	if resp == nil {
+		return data, nil
+	}
+	header := resp.Header.Clone()
+	for _, name := range cacheHopByHopHeaders {
+		header.Del(name)
+	}
+	respBytes, err := HTTPResponseToBytes(&http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, respBytes...), nil
+}
+
+// decodeCacheEntry - decode entry created by encodeCacheEntry
+func decodeCacheEntry(data []byte) (*cacheEntry, error) {
+	pos := bytes.IndexByte(data, '\n')
+	if pos < 0 {
+		return nil, ErrCacheMiss
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data[:pos], &entry.meta); err != nil {
+		return nil, err
+	}
+	if pos+1 == len(data) {
+		return entry, nil
+	}
+	resp, err := HTTPResponseFromBytes(data[pos+1:])
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	entry.body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	entry.resp = resp
+	return entry, nil
+}
+
+// cacheBodyReader - response body that captures content for storage
+type cacheBodyReader struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	finished bool
+	done     func(body []byte)
+}
+
+// Read - read from body, store once fully read
+func (r *cacheBodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.overflow {
+		if r.limit > 0 && int64(r.buf.Len()+n) > r.limit {
+			r.overflow = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !r.overflow && !r.finished {
+		r.finished = true
+		r.done(r.buf.Bytes())
+	}
+	return n, err
+}
+
+// cacheKey - primary cache key for request
+func cacheKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// cacheVaryKey - secondary cache key for request variant
+func cacheVaryKey(key string, vary []string, header http.Header) string {
+	for _, name := range vary {
+		key += "\x00" + name + ":" + strings.Join(header.Values(name), ",")
+	}
+	return key
+}
+
+// cacheVaryHeaders - sorted canonical header names listed in Vary
+func cacheVaryHeaders(header http.Header) []string {
+	vary := make([]string, 0)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// cacheNotModified - evaluate client conditional headers against stored response
+func cacheNotModified(conditional http.Header, header http.Header) bool {
+	if conditional == nil {
+		return false
+	}
+	if ifNoneMatch := conditional.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, value := range strings.Split(ifNoneMatch, ",") {
+			value = strings.TrimSpace(value)
+			if value == "*" || strings.TrimPrefix(value, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(conditional.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// parseCacheControl - parse Cache-Control directives, lower case names
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if pos := strings.Index(directive, "="); pos >= 0 {
+				name, arg = directive[:pos], strings.Trim(directive[pos+1:], "\"")
+			}
+			directives[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	// Pragma: no-cache is only honoured without Cache-Control
+	if len(directives) == 0 && strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		directives["no-cache"] = ""
+	}
+	return directives
+}
+
+// cacheDirectiveSeconds - get directive value as duration
+func cacheDirectiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// isSafeMethod - determine if request method is safe
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,337 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// CacheStorageMemory - denotes in-memory cache storage
+const CacheStorageMemory = "memory"
+
+// CacheStorageDisk - denotes on-disk cache storage
+const CacheStorageDisk = "disk"
+
+// ErrCacheMiss - returned by cache storage when key is not found
+var ErrCacheMiss = errors.New("cache miss")
+
+// CacheStorage - storage backend for cache entries
+type CacheStorage interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+// NewCacheStorage - create cache storage from config
+func NewCacheStorage(config *CacheConfig) (CacheStorage, error) {
+	switch config.Storage {
+	case CacheStorageMemory, "":
+		{
+			return NewMemoryCacheStorage(config.MaxEntries, config.MaxSize), nil
+		}
+	case CacheStorageDisk:
+		{
+			return NewDiskCacheStorage(config.Path, config.MaxSize)
+		}
+	}
+	return nil, errors.New("unknown cache storage '" + config.Storage + "'")
+}
+
+// cacheStorageKey - identifies storage shared by caches with the same
+// storage config
+type cacheStorageKey struct {
+	storage    string
+	path       string
+	maxEntries int
+	maxSize    int64
+}
+
+// sharedCacheStorage - storage and the number of caches using it
+type sharedCacheStorage struct {
+	storage CacheStorage
+	users   int
+}
+
+// cacheStorages - storages by storage config, the extension chains of every
+// virtual host and route share one storage and its size limits
+var cacheStorages = make(map[cacheStorageKey]*sharedCacheStorage)
+
+// cacheStoragesMutex - guards cache storages
+var cacheStoragesMutex sync.Mutex
+
+// acquireCacheStorage - get storage shared by every cache with the same
+// storage config, returned func releases it and forgets the storage once
+// no cache uses it
+func acquireCacheStorage(config *CacheConfig) (CacheStorage, func(), error) {
+	key := cacheStorageKey{storage: config.Storage, path: config.Path, maxEntries: config.MaxEntries, maxSize: config.MaxSize}
+	cacheStoragesMutex.Lock()
+	defer cacheStoragesMutex.Unlock()
+	shared, ok := cacheStorages[key]
+	if !ok {
+		storage, err := NewCacheStorage(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared = &sharedCacheStorage{storage: storage}
+		cacheStorages[key] = shared
+	}
+	shared.users++
+	release := func() {
+		cacheStoragesMutex.Lock()
+		defer cacheStoragesMutex.Unlock()
+		shared.users--
+		if shared.users == 0 && cacheStorages[key] == shared {
+			delete(cacheStorages, key)
+		}
+	}
+	return shared.storage, release, nil
+}
+
+// lruItem - item in lru index
+type lruItem struct {
+	key  string
+	size int64
+}
+
+// lruIndex - keys and sizes ordered by last use
+type lruIndex struct {
+	list  *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+// newLRUIndex - create empty lru index
+func newLRUIndex() *lruIndex {
+	return &lruIndex{
+		list:  list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// touch - mark key as most recently used
+func (i *lruIndex) touch(key string) {
+	if e, ok := i.items[key]; ok {
+		i.list.MoveToFront(e)
+	}
+}
+
+// add - add or replace key
+func (i *lruIndex) add(key string, size int64) {
+	i.remove(key)
+	i.items[key] = i.list.PushFront(&lruItem{key: key, size: size})
+	i.size += size
+}
+
+// remove - remove key
+func (i *lruIndex) remove(key string) {
+	if e, ok := i.items[key]; ok {
+		i.size -= e.Value.(*lruItem).size
+		i.list.Remove(e)
+		delete(i.items, key)
+	}
+}
+
+// oldest - get least recently used key
+func (i *lruIndex) oldest() (string, bool) {
+	e := i.list.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(*lruItem).key, true
+}
+
+// MemoryCacheStorage - in-memory cache storage with lru eviction
+type MemoryCacheStorage struct {
+	maxEntries int
+	maxSize    int64
+	mutex      sync.Mutex
+	index      *lruIndex
+	data       map[string][]byte
+}
+
+// NewMemoryCacheStorage - create in-memory cache storage, zero limits are unbounded
+func NewMemoryCacheStorage(maxEntries int, maxSize int64) *MemoryCacheStorage {
+	return &MemoryCacheStorage{
+		maxEntries: maxEntries,
+		maxSize:    maxSize,
+		index:      newLRUIndex(),
+		data:       make(map[string][]byte),
+	}
+}
+
+// Get - get entry
+func (s *MemoryCacheStorage) Get(key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.data[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	s.index.touch(key)
+	return value, nil
+}
+
+// Set - set entry, evicting least recently used entries when over limits
+func (s *MemoryCacheStorage) Set(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data[key] = value
+	s.index.add(key, int64(len(value)))
+	for (s.maxEntries > 0 && len(s.data) > s.maxEntries) || (s.maxSize > 0 && s.index.size > s.maxSize) {
+		oldKey, ok := s.index.oldest()
+		if !ok {
+			break
+		}
+		s.index.remove(oldKey)
+		delete(s.data, oldKey)
+	}
+	return nil
+}
+
+// Delete - delete entry
+func (s *MemoryCacheStorage) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.index.remove(key)
+	delete(s.data, key)
+	return nil
+}
+
+// DiskCacheStorage - on-disk cache storage with lru eviction
+type DiskCacheStorage struct {
+	path    string
+	maxSize int64
+	mutex   sync.Mutex
+	index   *lruIndex
+}
+
+// NewDiskCacheStorage - create on-disk cache storage in given directory,
+// existing entries are kept, zero max size is unbounded
+func NewDiskCacheStorage(path string, maxSize int64) (*DiskCacheStorage, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	s := &DiskCacheStorage{
+		path:    path,
+		maxSize: maxSize,
+		index:   newLRUIndex(),
+	}
+	// index existing entries, oldest first
+	type diskEntry struct {
+		name string
+		info os.FileInfo
+	}
+	entries := make([]diskEntry, 0)
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || len(info.Name()) != sha256.Size*2 {
+			return err
+		}
+		entries = append(entries, diskEntry{name: filepath.Base(p), info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].info.ModTime().Before(entries[j].info.ModTime())
+	})
+	for _, e := range entries {
+		s.index.add(e.name, e.info.Size())
+	}
+	return s, nil
+}
+
+// filename - get entry file name and full path for key
+func (s *DiskCacheStorage) filename(key string) (string, string) {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return name, filepath.Join(s.path, name[0:2], name)
+}
+
+// Get - get entry
+func (s *DiskCacheStorage) Get(key string) ([]byte, error) {
+	name, p := s.filename(key)
+	value, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.index.touch(name)
+	s.mutex.Unlock()
+	return value, nil
+}
+
+// Set - set entry, evicting least recently used entries when over max size
+func (s *DiskCacheStorage) Set(key string, value []byte) error {
+	name, p := s.filename(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	// write to temp file first so readers never see a partial entry
+	f, err := ioutil.TempFile(filepath.Dir(p), name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.index.add(name, int64(len(value)))
+	for s.maxSize > 0 && s.index.size > s.maxSize {
+		oldName, ok := s.index.oldest()
+		if !ok {
+			break
+		}
+		s.index.remove(oldName)
+		os.Remove(filepath.Join(s.path, oldName[0:2], oldName))
+	}
+	return nil
+}
+
+// Delete - delete entry
+func (s *DiskCacheStorage) Delete(key string) error {
+	name, p := s.filename(key)
+	s.mutex.Lock()
+	s.index.remove(name)
+	s.mutex.Unlock()
+	err := os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
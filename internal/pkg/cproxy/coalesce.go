@@ -0,0 +1,209 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalesceKeyHeaders - request headers that must match for requests to share a fetch
+var coalesceKeyHeaders = []string{"If-None-Match", "If-Modified-Since", "Range"}
+
+// coalesceCall - backend fetch shared by identical concurrent requests
+type coalesceCall struct {
+	done   chan struct{}
+	header http.Header // request headers of the fetch, compared against Vary
+	resp   *http.Response
+	body   []byte
+	err    error
+}
+
+// coalesceCalls - running fetches by key
+var coalesceCalls = make(map[string]*coalesceCall)
+
+// coalesceCallsMutex - guards coalesce calls
+var coalesceCallsMutex sync.Mutex
+
+// coalesceFetch - fetch from backend, identical requests that arrive while a
+// fetch is running wait for it and receive a copy of its response, not in
+// stream mode as sharing a response needs its whole body
+func coalesceFetch(req *http.Request, config *Config) (*http.Response, error) {
+	if !config.Coalesce.Enabled || config.StreamResponse || !isCoalescable(req) {
+		return BackendFetch(req, config)
+	}
+	key := coalesceKey(req)
+	coalesceCallsMutex.Lock()
+	if call, ok := coalesceCalls[key]; ok {
+		coalesceCallsMutex.Unlock()
+		return call.wait(req, config)
+	}
+	call := &coalesceCall{
+		done:   make(chan struct{}),
+		header: req.Header.Clone(),
+	}
+	coalesceCalls[key] = call
+	coalesceCallsMutex.Unlock()
+	resp, err := BackendFetch(req, config)
+	resp = call.finish(req, resp, err, config.Coalesce.MaxBodySize)
+	coalesceCallsMutex.Lock()
+	delete(coalesceCalls, key)
+	coalesceCallsMutex.Unlock()
+	close(call.done)
+	return resp, err
+}
+
+// wait - wait for running fetch, falls back to own fetch on timeout or when
+// the response can not be shared with this request
+func (c *coalesceCall) wait(req *http.Request, config *Config) (*http.Response, error) {
+	var timeout <-chan time.Time
+	if config.Coalesce.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(config.Coalesce.Timeout))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c.done:
+		{
+			if c.shareable(req) {
+				RequestLogger(req).Debug("coalesced backend fetch")
+				return c.response(req)
+			}
+			break
+		}
+	case <-timeout:
+		{
+			RequestLogger(req).Debug("coalesced backend fetch timed out")
+			break
+		}
+	case <-req.Context().Done():
+		{
+			return nil, &BackendError{Err: req.Context().Err()}
+		}
+	}
+	return BackendFetch(req, config)
+}
+
+// finish - record fetch result, shareable response bodies are read in to
+// memory so each waiter gets its own copy
+func (c *coalesceCall) finish(req *http.Request, resp *http.Response, err error, maxBodySize int64) *http.Response {
+	if err != nil {
+		c.err = err
+		return resp
+	}
+	if !isCoalesceShareable(req, resp) || (maxBodySize > 0 && resp.ContentLength > maxBodySize) {
+		return resp
+	}
+	var reader io.Reader = resp.Body
+	if maxBodySize > 0 {
+		reader = io.LimitReader(resp.Body, maxBodySize+1)
+	}
+	body, readErr := ioutil.ReadAll(reader)
+	if readErr != nil || (maxBodySize > 0 && int64(len(body)) > maxBodySize) {
+		// not shared, leader still gets the full body
+		resp.Body = &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), resp.Body),
+			Closer: resp.Body,
+		}
+		return resp
+	}
+	resp.Body.Close()
+	// copy as the fetching request goes on to change its response
+	c.resp = &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Proto:      resp.Proto,
+		ProtoMajor: resp.ProtoMajor,
+		ProtoMinor: resp.ProtoMinor,
+		Header:     resp.Header.Clone(),
+	}
+	c.body = body
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp
+}
+
+// shareable - determine if fetch result can be given to waiting request,
+// otherwise the waiting request must do its own fetch
+func (c *coalesceCall) shareable(req *http.Request) bool {
+	if c.err != nil {
+		// fetch cancelled by its own client
+		return !errors.Is(c.err, context.Canceled)
+	}
+	if c.resp == nil {
+		return false
+	}
+	for _, name := range cacheVaryHeaders(c.resp.Header) {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(c.header.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// response - copy of fetch result for waiting request
+func (c *coalesceCall) response(req *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{
+		Status:        c.resp.Status,
+		StatusCode:    c.resp.StatusCode,
+		Proto:         c.resp.Proto,
+		ProtoMajor:    c.resp.ProtoMajor,
+		ProtoMinor:    c.resp.ProtoMinor,
+		Header:        c.resp.Header.Clone(),
+		ContentLength: int64(len(c.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		Request:       req,
+	}, nil
+}
+
+// coalesceKey - key identifying identical requests
+func coalesceKey(req *http.Request) string {
+	key := req.Method + " " + req.Host + req.URL.RequestURI()
+	for _, name := range coalesceKeyHeaders {
+		key += "\x00" + strings.Join(req.Header.Values(name), ",")
+	}
+	return key
+}
+
+// isCoalescable - determine if request may share a fetch with other
+// requests, requests with credentials never do
+func isCoalescable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Header.Get("Authorization") == "" && req.Header.Get("Cookie") == ""
+}
+
+// isCoalesceShareable - determine if response may be given to other clients,
+// only responses a shared cache may store that are explicitly marked for it
+func isCoalesceShareable(req *http.Request, resp *http.Response) bool {
+	return isSharedResponse(req, resp) && hasSharedFreshness(resp)
+}
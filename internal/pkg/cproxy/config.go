@@ -1,107 +1,442 @@
-/*
-This file is part of CProxy.
-
-CProxy is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-CProxy is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package cproxy
-
-import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
-)
-
-// AppName - name of this application
-const AppName = "CProxy"
-
-// VersionNo - current version of this application
-const VersionNo = 1
-
-// DefaultConfigFilePath - default path to config file
-const DefaultConfigFilePath = "cproxy.json"
-
-// ProxyTypeHTTP - denotes HTTP proxy
-const ProxyTypeHTTP = "http"
-
-// ProxyTypeFCGI - denotes FastCGI proxy
-const ProxyTypeFCGI = "fcgi"
-
-// ProxyTypeDummy - denotes dummy test proxy
-const ProxyTypeDummy = "dummy"
-
-// Config - app configuration struct
-type Config struct {
-	ProxyType  string `json:"proxy_type"`
-	Listen     string `json:"listen"`  // 8081, /app/listen.sock
-	Backend    string `json:"backend"` // 127.0.0.1:9000, /app/run.sock, https://www.example.com
-	Extensions struct {
-		Path    string                     `json:"path"`
-		Enabled []string                   `json:"enabled"`
-		Config  map[string]json.RawMessage `json:"config"`
-	} `json:"extensions"`
-}
-
-// GetDefaultConfig - get default configuration values
-func GetDefaultConfig() Config {
-	// get listen port from env var (platform.sh)
-	listenPort := os.Getenv("PORT")
-	proxyType := ProxyTypeFCGI // assume fcgi if port env var
-	if listenPort == "" {
-		listenPort = "8081"
-		proxyType = ProxyTypeHTTP
-	}
-	listenPort = ":" + listenPort
-	config := Config{
-		ProxyType: proxyType,
-		Listen:    listenPort,
-		Backend:   "/run/app.sock",
-	}
-	config.Extensions.Path = "ext"
-	execPath, err := os.Executable()
-	if err == nil {
-		config.Extensions.Path = filepath.Join(filepath.Dir(execPath), "ext")
-	}
-	return config
-}
-
-// LoadConfigFile - load configuration from file
-func LoadConfigFile(configFilePath string) Config {
-	if configFilePath == "" {
-		configFilePath = DefaultConfigFilePath
-		execPath, err := os.Executable()
-		if err == nil {
-			configFilePath = filepath.Join(filepath.Dir(execPath), DefaultConfigFilePath)
-		}
-	}
-	config := GetDefaultConfig()
-	f, err := os.Open(configFilePath)
-	if err != nil {
-		log.Println("CONFIG :: Warning,", err)
-		return config
-	}
-	defer f.Close()
-	configBytes, err := ioutil.ReadAll(f)
-	if err != nil {
-		log.Println("CONFIG :: Warning,", err)
-		return config
-	}
-	err = json.Unmarshal(configBytes, &config)
-	if err != nil {
-		log.Println("CONFIG :: Warning,", err)
-	}
-	return config
-}
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// AppName - name of this application
+const AppName = "CProxy"
+
+// VersionNo - current version of this application
+const VersionNo = 1
+
+// DefaultConfigFilePath - default path to config file
+const DefaultConfigFilePath = "cproxy.json"
+
+// ProxyTypeHTTP - denotes HTTP proxy
+const ProxyTypeHTTP = "http"
+
+// ProxyTypeFCGI - denotes FastCGI proxy
+const ProxyTypeFCGI = "fcgi"
+
+// ProxyTypeStatic - denotes files served from disk, for virtual hosts and
+// routes
+const ProxyTypeStatic = "static"
+
+// ProxyTypeDummy - denotes dummy test proxy
+const ProxyTypeDummy = "dummy"
+
+// Config - app configuration struct
+type Config struct {
+	ProxyType       string                     `json:"proxy_type"`
+	Listen          string                     `json:"listen"`   // 8081, /app/listen.sock
+	Backend         string                     `json:"backend"`  // 127.0.0.1:9000, /app/run.sock, https://www.example.com
+	Backends        []BackendConfig            `json:"backends"` // replaces backend when set
+	Balancer        BalancerConfig             `json:"balancer"`
+	StreamResponse  bool                       `json:"stream_response"` // pass backend response body through as it arrives
+	Timeout         Duration                   `json:"timeout"`         // time allowed for backend response, including retries
+	Static          StaticConfig               `json:"static"`
+	HTTP            HTTPConfig                 `json:"http"`
+	FCGI            FCGIConfig                 `json:"fcgi"`
+	Cache           CacheConfig                `json:"cache"`
+	Coalesce        CoalesceConfig             `json:"coalesce"`
+	HealthCheck     HealthCheckConfig          `json:"health_check"`
+	Retry           RetryConfig                `json:"retry"`
+	Log             LogConfig                  `json:"log"`
+	AccessLog       AccessLogConfig            `json:"access_log"`
+	Tracing         TracingConfig              `json:"tracing"`
+	Admin           AdminConfig                `json:"admin"`
+	ShutdownTimeout Duration                   `json:"shutdown_timeout"` // time to wait for in-flight requests
+	ErrorPages      map[string]ErrorPageConfig `json:"error_pages"`      // status code or "default"
+	Extensions      ExtensionsConfig           `json:"extensions"`
+	Routes          []RouteConfig              `json:"routes"` // first route matching the request is used
+	Hosts           []HostConfig               `json:"hosts"`  // virtual hosts, replace the main backend and extensions when set
+	source          *configSource              // file config was loaded from, used to position errors
+	errorPages      errorPageTemplates         // compiled by ValidateConfig
+}
+
+// ExtensionsConfig - extensions to load and their config by name
+type ExtensionsConfig struct {
+	Path    string                     `json:"path"`
+	Enabled []string                   `json:"enabled"`
+	Config  map[string]json.RawMessage `json:"config"`
+}
+
+// HostConfig - virtual host selected by the request Host header, values
+// that are not set are taken from the main config
+type HostConfig struct {
+	Names      []string         `json:"names"`   // www.example.com, *.example.com
+	Default    bool             `json:"default"` // handles requests no host name matches
+	ProxyType  string           `json:"proxy_type"`
+	Backend    string           `json:"backend"`
+	Backends   []BackendConfig  `json:"backends"`
+	Static     StaticConfig     `json:"static"`
+	Extensions ExtensionsConfig `json:"extensions"` // config is merged by extension name
+	Routes     []RouteConfig    `json:"routes"`     // replace the main routes when set
+}
+
+// RouteConfig - route matched by request path, method and headers, values
+// that are not set are taken from the virtual host or main config
+type RouteConfig struct {
+	Prefix     string            `json:"prefix"`  // /api, matches the path and the paths below it
+	Regex      string            `json:"regex"`   // matched against the path
+	Methods    []string          `json:"methods"` // any method when empty
+	Headers    map[string]string `json:"headers"` // header name to regex of value, empty to require the header
+	ProxyType  string            `json:"proxy_type"`
+	Backend    string            `json:"backend"`
+	Backends   []BackendConfig   `json:"backends"`
+	Static     StaticConfig      `json:"static"`
+	Timeout    Duration          `json:"timeout"`
+	Extensions ExtensionsConfig  `json:"extensions"` // route has its own extension chain when set
+}
+
+// StaticConfig - files served by the static proxy type
+type StaticConfig struct {
+	Root  string `json:"root"`  // directory the request path is looked up in
+	Index string `json:"index"` // file served for directories
+}
+
+// Duration - time duration, configured as a string ("30s") or number of seconds
+type Duration time.Duration
+
+// UnmarshalJSON - read duration from string or number of seconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		{
+			*d = Duration(value * float64(time.Second))
+			return nil
+		}
+	case string:
+		{
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			*d = Duration(duration)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid duration %s", string(b))
+}
+
+// MarshalJSON - write duration as string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ErrorPageConfig - error page template, from file or inline
+type ErrorPageConfig struct {
+	File     string `json:"file"`
+	Template string `json:"template"`
+}
+
+// BackendConfig - backend address and balancing weight
+type BackendConfig struct {
+	Address string `json:"address"` // 127.0.0.1:9000, /app/run.sock, https://www.example.com
+	Weight  int    `json:"weight"`
+}
+
+// BalancerConfig - load balancing configuration
+type BalancerConfig struct {
+	Strategy   string `json:"strategy"`    // round_robin, least_conn, random_two, hash
+	HashHeader string `json:"hash_header"` // hash strategy key
+	HashCookie string `json:"hash_cookie"`
+}
+
+// HTTPConfig - HTTP backend transport configuration
+type HTTPConfig struct {
+	DialTimeout           Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`
+	MaxIdleConns          int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"`
+	HTTP2                 bool     `json:"http2"`
+	CAFile                string   `json:"ca_file"`   // PEM bundle added to system roots
+	CertFile              string   `json:"cert_file"` // client certificate
+	KeyFile               string   `json:"key_file"`
+	InsecureSkipVerify    bool     `json:"insecure_skip_verify"`
+}
+
+// FCGIConfig - FastCGI backend connection pool configuration
+type FCGIConfig struct {
+	MaxIdleConns int      `json:"max_idle_conns"` // zero disables keep-alive
+	MaxOpenConns int      `json:"max_open_conns"` // zero is unlimited
+	IdleTimeout  Duration `json:"idle_timeout"`
+	DialTimeout  Duration `json:"dial_timeout"`
+}
+
+// CacheConfig - http response cache configuration
+type CacheConfig struct {
+	Enabled              bool     `json:"enabled"`
+	Storage              string   `json:"storage"`                // memory, disk
+	Path                 string   `json:"path"`                   // directory for disk storage
+	MaxEntries           int      `json:"max_entries"`            // memory storage only
+	MaxSize              int64    `json:"max_size"`               // total size in bytes
+	MaxEntrySize         int64    `json:"max_entry_size"`         // largest response to store in bytes
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"` // used when response has no directive
+	StaleIfError         Duration `json:"stale_if_error"`
+}
+
+// HealthCheckConfig - active and passive backend health check configuration
+type HealthCheckConfig struct {
+	Interval           Duration `json:"interval"` // active check interval, 0 disables
+	Timeout            Duration `json:"timeout"`
+	Path               string   `json:"path"`                // http path or fcgi script to request
+	HealthyThreshold   int      `json:"healthy_threshold"`   // passed checks before backend returns
+	UnhealthyThreshold int      `json:"unhealthy_threshold"` // failed checks before backend is ejected
+	MaxFailures        int      `json:"max_failures"`        // failed requests before backend is ejected, 0 disables
+	EjectionTime       Duration `json:"ejection_time"`       // time backend is ejected after failed requests
+}
+
+// RetryConfig - backend retry policy
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // including first attempt, 1 disables retries
+	Backoff     Duration `json:"backoff"`      // delay before first retry, doubled every retry
+	MaxBackoff  Duration `json:"max_backoff"`
+	StatusCodes []int    `json:"status_codes"`  // response status codes to retry
+	Methods     []string `json:"methods"`       // request methods that may be retried
+	MaxBodySize int64    `json:"max_body_size"` // largest request body buffered for retries
+}
+
+// CoalesceConfig - request coalescing configuration
+type CoalesceConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Timeout     Duration `json:"timeout"`       // time to wait for a running fetch before fetching
+	MaxBodySize int64    `json:"max_body_size"` // largest response body shared in bytes
+}
+
+// LogConfig - logging configuration
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn, error
+	Format string `json:"format"` // text, logfmt, json
+	Output string `json:"output"` // stderr, stdout or file path
+}
+
+// AccessLogConfig - access log configuration
+type AccessLogConfig struct {
+	Path   string `json:"path"`   // stdout or file path, empty disables
+	Format string `json:"format"` // common, combined, json or format string with $variables
+}
+
+// TracingConfig - opentelemetry tracing configuration
+type TracingConfig struct {
+	Endpoint      string            `json:"endpoint"` // otlp/http traces url, http://127.0.0.1:4318/v1/traces, empty disables
+	ServiceName   string            `json:"service_name"`
+	Headers       map[string]string `json:"headers"`      // sent with every export, i.e. authentication
+	SampleRatio   float64           `json:"sample_ratio"` // share of new traces recorded, incoming traceparent flags are honored
+	BatchSize     int               `json:"batch_size"`
+	FlushInterval Duration          `json:"flush_interval"`
+	Timeout       Duration          `json:"timeout"`
+}
+
+// AdminConfig - admin listener configuration
+type AdminConfig struct {
+	Listen string `json:"listen"` // 127.0.0.1:8082, /app/admin.sock, empty disables
+	Token  string `json:"token"`  // bearer token, required unless listening on a unix socket
+}
+
+// GetDefaultConfig - get default configuration values
+func GetDefaultConfig() Config {
+	// get listen port from env var (platform.sh)
+	listenPort := os.Getenv("PORT")
+	proxyType := ProxyTypeFCGI // assume fcgi if port env var
+	if listenPort == "" {
+		listenPort = "8081"
+		proxyType = ProxyTypeHTTP
+	}
+	listenPort = ":" + listenPort
+	config := Config{
+		ProxyType:       proxyType,
+		Listen:          listenPort,
+		Backend:         "/run/app.sock",
+		ShutdownTimeout: Duration(30 * time.Second),
+		Balancer:        BalancerConfig{Strategy: BalancerRoundRobin},
+	}
+	config.Extensions.Path = "ext"
+	config.Static.Index = "index.html"
+	config.HTTP.DialTimeout = Duration(10 * time.Second)
+	config.HTTP.TLSHandshakeTimeout = Duration(10 * time.Second)
+	config.HTTP.ResponseHeaderTimeout = Duration(60 * time.Second)
+	config.HTTP.IdleConnTimeout = Duration(90 * time.Second)
+	config.HTTP.MaxIdleConns = 100
+	config.HTTP.MaxIdleConnsPerHost = 32
+	config.HTTP.HTTP2 = true
+	config.FCGI.MaxIdleConns = 16
+	config.FCGI.IdleTimeout = Duration(60 * time.Second)
+	config.FCGI.DialTimeout = Duration(5 * time.Second)
+	config.Cache.Storage = CacheStorageMemory
+	config.Cache.Path = "cache"
+	config.Cache.MaxEntries = 10000
+	config.Cache.MaxSize = 256 * 1024 * 1024
+	config.Cache.MaxEntrySize = 10 * 1024 * 1024
+	config.Retry.MaxAttempts = 1
+	config.Retry.Backoff = Duration(100 * time.Millisecond)
+	config.Retry.MaxBackoff = Duration(2 * time.Second)
+	config.Retry.StatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	config.Retry.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace}
+	config.Retry.MaxBodySize = 1024 * 1024
+	config.Coalesce.Timeout = Duration(10 * time.Second)
+	config.Coalesce.MaxBodySize = 10 * 1024 * 1024
+	config.Log.Level = LogLevelInfo.String()
+	config.Log.Format = LogFormatText
+	config.AccessLog.Format = AccessLogCombined
+	config.Tracing.ServiceName = strings.ToLower(AppName)
+	config.Tracing.SampleRatio = 1
+	config.Tracing.BatchSize = 512
+	config.Tracing.FlushInterval = Duration(5 * time.Second)
+	config.Tracing.Timeout = Duration(10 * time.Second)
+	config.HealthCheck.Timeout = Duration(5 * time.Second)
+	config.HealthCheck.Path = "/"
+	config.HealthCheck.HealthyThreshold = 2
+	config.HealthCheck.UnhealthyThreshold = 3
+	config.HealthCheck.EjectionTime = Duration(30 * time.Second)
+	execPath, err := os.Executable()
+	if err == nil {
+		config.Extensions.Path = filepath.Join(filepath.Dir(execPath), "ext")
+		config.Cache.Path = filepath.Join(filepath.Dir(execPath), "cache")
+	}
+	return config
+}
+
+// LoadConfigFile - load json, yaml or toml configuration from file on top of
+// the defaults after environment variables are interpolated, included files,
+// the environment overlay and local overrides are merged in, unknown keys and
+// values of the wrong type are rejected with their position
+func LoadConfigFile(configFilePath string) (Config, error) {
+	if configFilePath == "" {
+		configFilePath = DefaultConfigFilePath
+		execPath, err := os.Executable()
+		if err == nil {
+			configFilePath = filepath.Join(filepath.Dir(execPath), DefaultConfigFilePath)
+		}
+	}
+	config := GetDefaultConfig()
+	layer, err := loadConfigLayers(configFilePath)
+	if err != nil {
+		return config, err
+	}
+	layer.value = coerceConfigValue(layer.value, "", reflect.TypeOf(config), layer.interpolated)
+	configBytes, err := json.Marshal(layer.value)
+	if err != nil {
+		return config, err
+	}
+	source := &configSource{file: configFilePath, positions: layer.positions}
+	if err := decodeConfig(source, configBytes, &config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// GetHostConfig - get config requests of virtual host are handled with, the
+// main config with the values set by the host
+func (c *Config) GetHostConfig(host *HostConfig) *Config {
+	config := c.override(host.ProxyType, host.Backend, host.Backends, &host.Static, &host.Extensions)
+	if host.Routes != nil {
+		config.Routes = host.Routes
+	}
+	return config
+}
+
+// GetRouteConfig - get config requests of route are handled with, the
+// virtual host or main config with the values set by the route
+func (c *Config) GetRouteConfig(route *RouteConfig) *Config {
+	config := c.override(route.ProxyType, route.Backend, route.Backends, &route.Static, &route.Extensions)
+	config.Routes = nil
+	if route.Timeout > 0 {
+		config.Timeout = route.Timeout
+	}
+	return config
+}
+
+// override - get copy of config with the values set by a virtual host or
+// route
+func (c *Config) override(proxyType string, backend string, backends []BackendConfig, static *StaticConfig, exts *ExtensionsConfig) *Config {
+	config := *c
+	config.Hosts = nil
+	if proxyType != "" {
+		config.ProxyType = proxyType
+	}
+	if backend != "" || len(backends) > 0 {
+		config.Backend = backend
+		config.Backends = backends
+	}
+	if static.Root != "" {
+		config.Static.Root = static.Root
+	}
+	if static.Index != "" {
+		config.Static.Index = static.Index
+	}
+	if exts.Path != "" {
+		config.Extensions.Path = exts.Path
+	}
+	if exts.Enabled != nil {
+		config.Extensions.Enabled = exts.Enabled
+	}
+	config.Extensions.Config = make(map[string]json.RawMessage)
+	for name, rawConfig := range c.Extensions.Config {
+		config.Extensions.Config[name] = rawConfig
+	}
+	for name, rawConfig := range exts.Config {
+		config.Extensions.Config[name] = rawConfig
+	}
+	return &config
+}
+
+// getSiteConfigs - get configs requests are handled with, one per virtual
+// host or the main config when there are none, followed by one per route
+func (c *Config) getSiteConfigs() []*Config {
+	hostConfigs := []*Config{c}
+	if len(c.Hosts) > 0 {
+		hostConfigs = make([]*Config, 0, len(c.Hosts))
+		for i := range c.Hosts {
+			hostConfigs = append(hostConfigs, c.GetHostConfig(&c.Hosts[i]))
+		}
+	}
+	configs := make([]*Config, 0, len(hostConfigs))
+	for _, hostConfig := range hostConfigs {
+		configs = append(configs, hostConfig)
+		for i := range hostConfig.Routes {
+			configs = append(configs, hostConfig.GetRouteConfig(&hostConfig.Routes[i]))
+		}
+	}
+	return configs
+}
+
+// GetBackends - get configured backends, single backend setting is used
+// when no backend list is given
+func (c *Config) GetBackends() []BackendConfig {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	return []BackendConfig{{Address: c.Backend, Weight: 1}}
+}
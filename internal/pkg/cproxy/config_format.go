@@ -0,0 +1,463 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFormatJSON - denotes json config file
+const ConfigFormatJSON = "json"
+
+// ConfigFormatYAML - denotes yaml config file
+const ConfigFormatYAML = "yaml"
+
+// ConfigFormatTOML - denotes toml config file
+const ConfigFormatTOML = "toml"
+
+// configEnvVariable - matches ${VAR}, ${VAR:-default} and escaped $${
+var configEnvVariable = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// GetConfigFormat - get config format from file extension, json unless
+// the extension is .yaml, .yml or .toml
+func GetConfigFormat(configFilePath string) string {
+	switch strings.ToLower(filepath.Ext(configFilePath)) {
+	case ".yaml", ".yml":
+		{
+			return ConfigFormatYAML
+		}
+	case ".toml":
+		{
+			return ConfigFormatTOML
+		}
+	}
+	return ConfigFormatJSON
+}
+
+// parseConfigLayer - decode config file in the format given by its
+// extension and interpolate environment variables in its string values,
+// records the position of every key and value
+func parseConfigLayer(file string, data []byte) (*configLayer, error) {
+	source := &configSource{file: file, data: data}
+	var err error
+	switch GetConfigFormat(file) {
+	case ConfigFormatYAML:
+		{
+			data, err = yamlToJSON(source, data)
+			break
+		}
+	case ConfigFormatTOML:
+		{
+			data, err = tomlToJSON(source, data)
+			break
+		}
+	default:
+		{
+			err = jsonPositions(source, data)
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	layer := &configLayer{positions: source.positions, interpolated: make(map[string]bool)}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&layer.value); err != nil {
+		return nil, decodeError(source, 0, err)
+	}
+	if _, ok := layer.value.(map[string]interface{}); !ok {
+		return nil, source.errorAtPath("", errors.New("expected object"))
+	}
+	errs := ConfigErrors{}
+	layer.value = interpolateConfig(source, layer, layer.value, "", &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for keyPath, position := range layer.positions {
+		position.file = file
+		layer.positions[keyPath] = position
+	}
+	return layer, nil
+}
+
+// jsonPositions - record the position of every key and value in json
+// document
+func jsonPositions(source *configSource, data []byte) error {
+	source.offsets = make(map[string]int64)
+	if err := checkConfigKeys(source, data, 0, "", reflect.TypeOf((*interface{})(nil)).Elem()); err != nil {
+		return err
+	}
+	source.positions = make(map[string]configPosition)
+	for keyPath, offset := range source.offsets {
+		line, column := lineColumn(data, offset)
+		source.positions[keyPath] = configPosition{line: line, column: column}
+	}
+	return nil
+}
+
+// interpolateConfig - replace ${VAR} in every string value of decoded
+// config with the value of environment variable VAR and ${VAR:-default} with
+// default when VAR is unset or empty, $${ is kept as a literal ${, values
+// that are a single variable are recorded so they can be coerced to the type
+// of their field
+func interpolateConfig(source *configSource, layer *configLayer, value interface{}, keyPath string, errs *ConfigErrors) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		{
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				childPath := key
+				if keyPath != "" {
+					childPath = keyPath + "." + key
+				}
+				v[key] = interpolateConfig(source, layer, v[key], childPath, errs)
+			}
+			return v
+		}
+	case []interface{}:
+		{
+			for i, item := range v {
+				v[i] = interpolateConfig(source, layer, item, keyPath+"["+strconv.Itoa(i)+"]", errs)
+			}
+			return v
+		}
+	case string:
+		{
+			if match := configEnvVariable.FindStringSubmatchIndex(v); match != nil && match[0] == 0 && match[1] == len(v) && match[2] >= 0 {
+				layer.interpolated[keyPath] = true
+			}
+			return interpolateString(source, v, keyPath, errs)
+		}
+	}
+	return value
+}
+
+// coerceConfigValue - decode interpolated values of number and bool fields
+// as json scalars, environment variables are always strings, values that do
+// not decode are left for the type check
+func coerceConfigValue(value interface{}, keyPath string, t reflect.Type, interpolated map[string]bool) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		{
+			for key, childValue := range v {
+				childPath := key
+				if keyPath != "" {
+					childPath = keyPath + "." + key
+				}
+				switch t.Kind() {
+				case reflect.Struct:
+					{
+						if field, ok := configField(t, key); ok {
+							v[key] = coerceConfigValue(childValue, childPath, field.Type, interpolated)
+						}
+						break
+					}
+				case reflect.Map:
+					{
+						v[key] = coerceConfigValue(childValue, childPath, t.Elem(), interpolated)
+						break
+					}
+				}
+			}
+			return v
+		}
+	case []interface{}:
+		{
+			if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+				return v
+			}
+			for i, item := range v {
+				v[i] = coerceConfigValue(item, keyPath+"["+strconv.Itoa(i)+"]", t.Elem(), interpolated)
+			}
+			return v
+		}
+	case string:
+		{
+			if !interpolated[keyPath] {
+				return v
+			}
+			switch t.Kind() {
+			case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+				{
+					decoder := json.NewDecoder(strings.NewReader(v))
+					decoder.UseNumber()
+					var scalar interface{}
+					if err := decoder.Decode(&scalar); err != nil || decoder.More() {
+						return v
+					}
+					switch scalar.(type) {
+					case json.Number, bool:
+						{
+							return scalar
+						}
+					}
+					break
+				}
+			}
+			return v
+		}
+	}
+	return value
+}
+
+// interpolateString - replace environment variables in string value, errors
+// are positioned at the value
+func interpolateString(source *configSource, value string, keyPath string, errs *ConfigErrors) string {
+	out := strings.Builder{}
+	last := 0
+	for _, match := range configEnvVariable.FindAllStringSubmatchIndex(value, -1) {
+		out.WriteString(value[last:match[0]])
+		last = match[1]
+		if match[2] < 0 {
+			out.WriteString("${")
+			continue
+		}
+		name := value[match[2]:match[3]]
+		envValue, ok := os.LookupEnv(name)
+		if match[4] >= 0 && envValue == "" {
+			envValue, ok = value[match[6]:match[7]], true
+		}
+		if !ok {
+			*errs = append(*errs, source.errorAtPath(keyPath, fmt.Errorf("environment variable '%s' is not set", name)))
+			continue
+		}
+		out.WriteString(envValue)
+	}
+	out.WriteString(value[last:])
+	return out.String()
+}
+
+// yamlToJSON - convert yaml document to json, records the position of
+// every value
+func yamlToJSON(source *configSource, data []byte) ([]byte, error) {
+	source.positions = make(map[string]configPosition)
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &ConfigError{File: source.file, Err: err}
+	}
+	out := bytes.Buffer{}
+	if len(root.Content) == 0 {
+		// empty document
+		out.WriteString("{}")
+		return out.Bytes(), nil
+	}
+	if err := writeYAMLNode(source, &out, root.Content[0], ""); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeYAMLNode - write yaml node as json, aliases keep the position of the
+// alias
+func writeYAMLNode(source *configSource, out *bytes.Buffer, node *yaml.Node, keyPath string) error {
+	if _, ok := source.positions[keyPath]; !ok {
+		source.positions[keyPath] = configPosition{line: node.Line, column: node.Column}
+	}
+	switch node.Kind {
+	case yaml.AliasNode:
+		{
+			return writeYAMLNode(source, out, node.Alias, keyPath)
+		}
+	case yaml.MappingNode:
+		{
+			out.WriteByte('{')
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				keyJSON, _ := json.Marshal(key.Value)
+				out.Write(keyJSON)
+				out.WriteByte(':')
+				childPath := key.Value
+				if keyPath != "" {
+					childPath = keyPath + "." + key.Value
+				}
+				source.positions[childPath+configKeySuffix] = configPosition{line: key.Line, column: key.Column}
+				if err := writeYAMLNode(source, out, node.Content[i+1], childPath); err != nil {
+					return err
+				}
+			}
+			out.WriteByte('}')
+			return nil
+		}
+	case yaml.SequenceNode:
+		{
+			out.WriteByte('[')
+			for i, item := range node.Content {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				if err := writeYAMLNode(source, out, item, keyPath+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+			out.WriteByte(']')
+			return nil
+		}
+	}
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return source.errorAtPath(keyPath, err)
+	}
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return source.errorAtPath(keyPath, err)
+	}
+	out.Write(valueJSON)
+	return nil
+}
+
+// tomlToJSON - convert toml document to json, records the position of keys,
+// values and tables
+func tomlToJSON(source *configSource, data []byte) ([]byte, error) {
+	values := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &ConfigError{
+				File:   source.file,
+				Line:   parseErr.Position.Line,
+				Column: parseErr.Position.Col,
+				Err:    errors.New(parseErr.Message),
+			}
+		}
+		return nil, &ConfigError{File: source.file, Err: err}
+	}
+	source.positions = tomlPositions(data)
+	return json.Marshal(values)
+}
+
+// tomlPositions - find position of keys, values and table headers by key
+// path, a line based scan that covers one key per line
+func tomlPositions(data []byte) map[string]configPosition {
+	positions := map[string]configPosition{"": {line: 1, column: 1}}
+	arrayTables := make(map[string]int)
+	prefix := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		column := len(line) - len(strings.TrimLeft(line, " \t")) + 1
+		position := configPosition{line: i + 1, column: column}
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			break
+		case strings.HasPrefix(trimmed, "[["):
+			{
+				name := tomlTablePath(arrayTables, strings.Trim(trimmed[:strings.Index(trimmed, "]]")+2], "[] "))
+				prefix = name + "[" + strconv.Itoa(arrayTables[name]) + "]"
+				arrayTables[name]++
+				positions[prefix] = position
+				positions[prefix+configKeySuffix] = position
+				break
+			}
+		case strings.HasPrefix(trimmed, "["):
+			{
+				prefix = tomlTablePath(arrayTables, strings.Trim(trimmed[:strings.Index(trimmed, "]")+1], "[] "))
+				positions[prefix] = position
+				positions[prefix+configKeySuffix] = position
+				break
+			}
+		case strings.Contains(trimmed, "="):
+			{
+				key := tomlKeyPath(strings.TrimSpace(trimmed[:strings.Index(trimmed, "=")]))
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+				positions[key+configKeySuffix] = position
+				value := line[strings.Index(line, "=")+1:]
+				position.column = len(line) - len(strings.TrimLeft(value, " \t")) + 1
+				positions[key] = position
+				break
+			}
+		}
+	}
+	return positions
+}
+
+// tomlTablePath - key path of table header, tables within an array of
+// tables belong to its last element
+func tomlTablePath(arrayTables map[string]int, name string) string {
+	name = tomlKeyPath(name)
+	for arrayName, count := range arrayTables {
+		if strings.HasPrefix(name, arrayName+".") {
+			return arrayName + "[" + strconv.Itoa(count-1) + "]" + name[len(arrayName):]
+		}
+	}
+	return name
+}
+
+// tomlKeyPath - dotted toml key without quotes
+func tomlKeyPath(key string) string {
+	parts := make([]string, 0)
+	part := strings.Builder{}
+	var quote rune
+	for _, c := range key {
+		switch {
+		case quote != 0 && c == quote:
+			{
+				quote = 0
+				break
+			}
+		case quote != 0:
+			{
+				part.WriteRune(c)
+				break
+			}
+		case c == '"' || c == '\'':
+			{
+				quote = c
+				break
+			}
+		case c == '.':
+			{
+				parts = append(parts, strings.TrimSpace(part.String()))
+				part.Reset()
+				break
+			}
+		default:
+			{
+				part.WriteRune(c)
+				break
+			}
+		}
+	}
+	parts = append(parts, strings.TrimSpace(part.String()))
+	return strings.Join(parts, ".")
+}
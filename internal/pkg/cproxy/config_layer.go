@@ -0,0 +1,200 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConfigEnvVar - environment variable naming the environment overlay
+const ConfigEnvVar = "CPROXY_ENV"
+
+// configIncludeKey - config key listing files to include
+const configIncludeKey = "include"
+
+// configLayer - decoded config file with the position of every key and value
+// and the key paths of values that are a single environment variable
+type configLayer struct {
+	value        interface{}
+	positions    map[string]configPosition
+	interpolated map[string]bool
+}
+
+// loadConfigLayers - load config file with its includes, then the
+// environment overlay and local override files when present
+func loadConfigLayers(configFilePath string) (*configLayer, error) {
+	layer, err := loadConfigLayer(configFilePath, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	for _, overlayPath := range getConfigOverlayPaths(configFilePath) {
+		overlay, err := loadConfigLayer(overlayPath, make(map[string]bool))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		mergeConfigLayer(layer, overlay)
+	}
+	return layer, nil
+}
+
+// getConfigOverlayPaths - paths of environment overlay and local override
+// files, config.json is overlaid by config.<env>.json and config.local.json
+func getConfigOverlayPaths(configFilePath string) []string {
+	ext := filepath.Ext(configFilePath)
+	base := strings.TrimSuffix(configFilePath, ext)
+	paths := make([]string, 0)
+	if env := os.Getenv(ConfigEnvVar); env != "" {
+		paths = append(paths, base+"."+env+ext)
+	}
+	return append(paths, base+".local"+ext)
+}
+
+// loadConfigLayer - load config file, included files are merged first with
+// the including file on top
+func loadConfigLayer(configFilePath string, loading map[string]bool) (*configLayer, error) {
+	data, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	layer, err := parseConfigLayer(configFilePath, data)
+	if err != nil {
+		return nil, err
+	}
+	root := layer.value.(map[string]interface{})
+	includeValue, ok := root[configIncludeKey]
+	if !ok {
+		return layer, nil
+	}
+	delete(root, configIncludeKey)
+	source := &configSource{file: configFilePath, positions: layer.positions}
+	includes := make(map[string]string)
+	includePaths := make([]string, 0)
+	switch value := includeValue.(type) {
+	case string:
+		{
+			includes[configIncludeKey] = value
+			includePaths = append(includePaths, configIncludeKey)
+			break
+		}
+	case []interface{}:
+		{
+			for i, item := range value {
+				keyPath := configIncludeKey + "[" + strconv.Itoa(i) + "]"
+				include, ok := item.(string)
+				if !ok {
+					return nil, source.errorAtPath(keyPath, errors.New("expected string"))
+				}
+				includes[keyPath] = include
+				includePaths = append(includePaths, keyPath)
+			}
+			break
+		}
+	default:
+		{
+			return nil, source.errorAtPath(configIncludeKey, errors.New("expected string or list of strings"))
+		}
+	}
+	absPath, _ := filepath.Abs(configFilePath)
+	loading[absPath] = true
+	defer delete(loading, absPath)
+	merged := &configLayer{
+		value:        make(map[string]interface{}),
+		positions:    make(map[string]configPosition),
+		interpolated: make(map[string]bool),
+	}
+	for _, keyPath := range includePaths {
+		includePath := includes[keyPath]
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(configFilePath), includePath)
+		}
+		absIncludePath, _ := filepath.Abs(includePath)
+		if loading[absIncludePath] {
+			return nil, source.errorAtPath(keyPath, fmt.Errorf("include cycle at '%s'", includes[keyPath]))
+		}
+		included, err := loadConfigLayer(includePath, loading)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, source.errorAtPath(keyPath, fmt.Errorf("include file '%s' not found", includes[keyPath]))
+			}
+			return nil, err
+		}
+		mergeConfigLayer(merged, included)
+	}
+	mergeConfigLayer(merged, layer)
+	return merged, nil
+}
+
+// mergeConfigLayer - merge layer on top of base, objects are merged key by
+// key and any other value, including lists, replaces the base value
+func mergeConfigLayer(base *configLayer, layer *configLayer) {
+	base.value = mergeConfigValue(base, layer, base.value, layer.value, "")
+}
+
+// mergeConfigValue - merge value on top of base value at key path, the
+// positions and interpolated flags of replaced values are taken from layer
+func mergeConfigValue(base *configLayer, layer *configLayer, baseValue interface{}, value interface{}, keyPath string) interface{} {
+	baseObject, baseOk := baseValue.(map[string]interface{})
+	object, ok := value.(map[string]interface{})
+	if !ok || !baseOk {
+		for positionPath := range base.positions {
+			if isConfigSubPath(positionPath, keyPath) {
+				delete(base.positions, positionPath)
+			}
+		}
+		for positionPath, position := range layer.positions {
+			if isConfigSubPath(positionPath, keyPath) {
+				base.positions[positionPath] = position
+			}
+		}
+		for valuePath := range base.interpolated {
+			if isConfigSubPath(valuePath, keyPath) {
+				delete(base.interpolated, valuePath)
+			}
+		}
+		for valuePath := range layer.interpolated {
+			if isConfigSubPath(valuePath, keyPath) {
+				base.interpolated[valuePath] = true
+			}
+		}
+		return value
+	}
+	for key, childValue := range object {
+		childPath := key
+		if keyPath != "" {
+			childPath = keyPath + "." + key
+		}
+		baseObject[key] = mergeConfigValue(base, layer, baseObject[key], childValue, childPath)
+	}
+	return baseObject
+}
+
+// isConfigSubPath - determine if position path is at or below key path
+func isConfigSubPath(positionPath string, keyPath string) bool {
+	positionPath = strings.TrimSuffix(positionPath, configKeySuffix)
+	return keyPath == "" || positionPath == keyPath ||
+		strings.HasPrefix(positionPath, keyPath+".") || strings.HasPrefix(positionPath, keyPath+"[")
+}
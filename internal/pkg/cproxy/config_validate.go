@@ -0,0 +1,674 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ConfigError - config error with the position of the offending value
+type ConfigError struct {
+	File   string
+	Line   int // zero when position is unknown
+	Column int
+	Path   string // key path, i.e. backends[0].address
+	Err    error
+	offset int64
+}
+
+// Error - error message prefixed with file, line and column
+func (e *ConfigError) Error() string {
+	prefix := ""
+	if e.File != "" {
+		prefix = e.File + ":"
+	}
+	if e.Line > 0 {
+		prefix += strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Column) + ":"
+	}
+	if prefix != "" {
+		prefix += " "
+	}
+	if e.Path != "" {
+		prefix += e.Path + ": "
+	}
+	return prefix + e.Err.Error()
+}
+
+// Unwrap - get underlying error
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors - all errors found in config, one per line
+type ConfigErrors []*ConfigError
+
+// Error - error messages, one per line
+func (e ConfigErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// configKeySuffix - suffix of key path for the position of the key itself
+const configKeySuffix = "#"
+
+// configSource - config file contents and the offset of every value by key
+// path, merged config files keep the position of every value in the file it
+// came from
+type configSource struct {
+	file      string
+	data      []byte
+	offsets   map[string]int64
+	positions map[string]configPosition
+}
+
+// configPosition - file, line and column of value
+type configPosition struct {
+	file   string
+	line   int
+	column int
+}
+
+// errorAt - create error positioned at offset
+func (s *configSource) errorAt(offset int64, keyPath string, err error) *ConfigError {
+	if s.positions != nil {
+		return s.errorAtPath(keyPath, err)
+	}
+	line, column := lineColumn(s.data, offset)
+	return &ConfigError{File: s.file, Line: line, Column: column, Path: keyPath, Err: err, offset: offset}
+}
+
+// keyErrorAt - create error positioned at key
+func (s *configSource) keyErrorAt(offset int64, keyPath string, err error) *ConfigError {
+	if position, ok := s.positions[keyPath+configKeySuffix]; ok {
+		return &ConfigError{File: position.file, Line: position.line, Column: position.column, Path: keyPath, Err: err}
+	}
+	return s.errorAt(offset, keyPath, err)
+}
+
+// lineColumn - get line and column of offset
+func lineColumn(data []byte, offset int64) (int, int) {
+	line, column := 1, 1
+	for i := int64(0); i < offset && i < int64(len(data)); i++ {
+		column++
+		if data[i] == '\n' {
+			line++
+			column = 1
+		}
+	}
+	return line, column
+}
+
+// errorFor - create error positioned at value of key path, without position
+// when the value did not come from the file
+func (s *configSource) errorFor(keyPath string, err error) *ConfigError {
+	if s == nil {
+		return &ConfigError{Path: keyPath, Err: err}
+	}
+	if s.positions != nil {
+		return s.errorAtPath(keyPath, err)
+	}
+	if offset, ok := s.offsets[keyPath]; ok {
+		return s.errorAt(offset, keyPath, err)
+	}
+	return &ConfigError{Path: keyPath, Err: err}
+}
+
+// errorAtPath - create error positioned at value of key path in yaml or toml
+// file, falls back to the closest parent with a known position
+func (s *configSource) errorAtPath(keyPath string, err error) *ConfigError {
+	for parent := keyPath; ; {
+		if position, ok := s.positions[parent]; ok {
+			if position.file == "" {
+				position.file = s.file
+			}
+			return &ConfigError{File: position.file, Line: position.line, Column: position.column, Path: keyPath, Err: err}
+		}
+		i := strings.LastIndexAny(parent, ".[")
+		if i <= 0 {
+			return &ConfigError{File: s.file, Path: keyPath, Err: err}
+		}
+		parent = parent[:i]
+	}
+}
+
+// decodeConfig - decode json config, rejects unknown keys
+func decodeConfig(source *configSource, data []byte, config *Config) error {
+	source.offsets = make(map[string]int64)
+	if err := checkConfigKeys(source, data, 0, "", reflect.TypeOf(config)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return decodeError(source, 0, err)
+	}
+	config.source = source
+	return nil
+}
+
+// ValidateExtensionConfig - decode extension config in to schema, a pointer
+// to a struct with json tags, unknown keys and values of the wrong type are
+// rejected, intended for use by extension validators
+func ValidateExtensionConfig(rawConfig []byte, schema interface{}) error {
+	if len(bytes.TrimSpace(rawConfig)) == 0 {
+		return nil
+	}
+	source := &configSource{data: rawConfig, offsets: make(map[string]int64)}
+	if err := checkConfigKeys(source, rawConfig, 0, "", reflect.TypeOf(schema)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(rawConfig, schema); err != nil {
+		return decodeError(source, 0, err)
+	}
+	return nil
+}
+
+// decodeError - position json decode error
+func decodeError(source *configSource, base int64, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		{
+			return source.errorAt(base+syntaxErr.Offset, "", errors.New(syntaxErr.Error()))
+		}
+	case errors.As(err, &typeErr):
+		{
+			// error offset is the end of the value, position at its start
+			end := base + typeErr.Offset
+			keyPath, start := typeErr.Field, int64(-1)
+			for valuePath, offset := range source.offsets {
+				if offset < end && offset > start {
+					keyPath, start = strings.TrimSuffix(valuePath, configKeySuffix), offset
+				}
+			}
+			if start < 0 {
+				start = end
+			}
+			return source.errorAt(start, keyPath, fmt.Errorf("expected %s got %s", typeErr.Type.String(), typeErr.Value))
+		}
+	}
+	return &ConfigError{File: source.file, Err: err}
+}
+
+// checkConfigKeys - walk json data and reject keys that have no matching
+// field in type, records the offset of every value
+func checkConfigKeys(source *configSource, data []byte, base int64, keyPath string, t reflect.Type) error {
+	checker := &configChecker{
+		source:  source,
+		data:    data,
+		base:    base,
+		decoder: json.NewDecoder(bytes.NewReader(data)),
+	}
+	if err := checker.check(t, keyPath); err != nil {
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			return err
+		}
+		return decodeError(source, base, err)
+	}
+	if len(checker.errs) > 0 {
+		return checker.errs
+	}
+	return nil
+}
+
+// configChecker - state of json key check
+type configChecker struct {
+	source  *configSource
+	data    []byte
+	base    int64 // offset of data within source
+	decoder *json.Decoder
+	errs    ConfigErrors
+}
+
+// offset - offset of next token
+func (c *configChecker) offset() int64 {
+	offset := c.decoder.InputOffset()
+	for offset < int64(len(c.data)) && strings.IndexByte(" \t\r\n,:", c.data[offset]) >= 0 {
+		offset++
+	}
+	return c.base + offset
+}
+
+// check - check value against type
+func (c *configChecker) check(t reflect.Type, keyPath string) error {
+	c.source.offsets[keyPath] = c.offset()
+	token, err := c.decoder.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		// scalar, type is checked when decoding
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// any value is walked for interface types, types that decode themselves
+	// and mismatched types are not walked
+	generic := t.Kind() == reflect.Interface
+	if !generic && (reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) ||
+		(delim == '{' && t.Kind() != reflect.Struct && t.Kind() != reflect.Map) ||
+		(delim == '[' && t.Kind() != reflect.Slice && t.Kind() != reflect.Array)) {
+		return c.skip()
+	}
+	elemType := t
+	if !generic && t.Kind() != reflect.Struct {
+		elemType = t.Elem()
+	}
+	if delim == '[' {
+		for i := 0; c.decoder.More(); i++ {
+			if err := c.check(elemType, keyPath+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+		_, err := c.decoder.Token()
+		return err
+	}
+	for c.decoder.More() {
+		keyOffset := c.offset()
+		token, err := c.decoder.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+		childPath := key
+		if keyPath != "" {
+			childPath = keyPath + "." + key
+		}
+		c.source.offsets[childPath+configKeySuffix] = keyOffset
+		if generic || t.Kind() == reflect.Map {
+			if err := c.check(elemType, childPath); err != nil {
+				return err
+			}
+			continue
+		}
+		field, ok := configField(t, key)
+		if !ok {
+			c.errs = append(c.errs, c.source.keyErrorAt(keyOffset, childPath, fmt.Errorf("unknown key '%s'", key)))
+			if err := c.skipValue(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.check(field.Type, childPath); err != nil {
+			return err
+		}
+	}
+	_, err = c.decoder.Token()
+	return err
+}
+
+// skip - skip rest of object or array
+func (c *configChecker) skip() error {
+	for depth := 1; depth > 0; {
+		token, err := c.decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+				continue
+			}
+			depth--
+		}
+	}
+	return nil
+}
+
+// skipValue - skip next value
+func (c *configChecker) skipValue() error {
+	token, err := c.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); ok && (delim == '{' || delim == '[') {
+		return c.skip()
+	}
+	return nil
+}
+
+// configField - get struct field for json key, matched like encoding/json
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// ValidateConfig - check config can be used to handle requests, all errors
+// found are returned as ConfigErrors
+func ValidateConfig(config *Config) error {
+	errs := ConfigErrors{}
+	fail := func(keyPath string, format string, args ...interface{}) {
+		errs = append(errs, config.source.errorFor(keyPath, fmt.Errorf(format, args...)))
+	}
+	// main proxy type is also the protocol listened for
+	switch config.ProxyType {
+	case ProxyTypeHTTP, ProxyTypeFCGI, ProxyTypeDummy:
+		break
+	case ProxyTypeStatic:
+		{
+			fail("proxy_type", "proxy type '%s' is only supported by virtual hosts and routes", config.ProxyType)
+			break
+		}
+	default:
+		{
+			fail("proxy_type", "unknown proxy type '%s', expected %s or %s", config.ProxyType, ProxyTypeHTTP, ProxyTypeFCGI)
+			break
+		}
+	}
+	switch config.Balancer.Strategy {
+	case BalancerRoundRobin, BalancerLeastConn, BalancerRandomTwo, BalancerHash:
+		break
+	default:
+		{
+			fail("balancer.strategy", "unknown balancer strategy '%s'", config.Balancer.Strategy)
+			break
+		}
+	}
+	if _, err := ParseLogLevel(config.Log.Level); err != nil {
+		fail("log.level", "%s", err)
+	}
+	switch config.Log.Format {
+	case LogFormatText, LogFormatLogfmt, LogFormatJSON:
+		break
+	default:
+		{
+			fail("log.format", "unknown log format '%s'", config.Log.Format)
+			break
+		}
+	}
+	if err := validateAccessLogFormat(config.AccessLog.Format); err != nil {
+		fail("access_log.format", "%s", err)
+	}
+	switch config.Cache.Storage {
+	case CacheStorageMemory, CacheStorageDisk:
+		break
+	default:
+		{
+			fail("cache.storage", "unknown cache storage '%s', expected %s or %s", config.Cache.Storage, CacheStorageMemory, CacheStorageDisk)
+			break
+		}
+	}
+	// error page templates are compiled once, requests use the compiled ones
+	templates, templateErrs := compileErrorPages(config)
+	errs = append(errs, templateErrs...)
+	config.errorPages = templates
+	if len(config.Hosts) == 0 {
+		errs = append(errs, validateSiteConfig(config, nil)...)
+	}
+	names := make(map[string]bool)
+	reported := make(map[string]bool)
+	defaultHost := false
+	for i := range config.Hosts {
+		host := &config.Hosts[i]
+		hostPath := "hosts[" + strconv.Itoa(i) + "]"
+		if host.Default {
+			if defaultHost {
+				fail(hostPath+".default", "more than one default host")
+			}
+			defaultHost = true
+		}
+		if len(host.Names) == 0 && !host.Default {
+			fail(hostPath+".names", "host has no names and is not the default host")
+		}
+		for j, name := range host.Names {
+			keyPath := hostPath + ".names[" + strconv.Itoa(j) + "]"
+			name = normalizeHostName(name)
+			if !isValidHostName(name) {
+				fail(keyPath, "invalid host name '%s'", host.Names[j])
+				continue
+			}
+			if names[name] {
+				fail(keyPath, "host name '%s' is used more than once", host.Names[j])
+			}
+			names[name] = true
+		}
+		site := &siteSource{
+			keyPath:   hostPath,
+			proxyType: host.ProxyType != "",
+			backend:   host.Backend != "" || len(host.Backends) > 0,
+			static:    host.Static.Root != "",
+			enabled:   host.Extensions.Enabled != nil,
+			extConfig: host.Extensions.Config,
+			routes:    host.Routes != nil,
+		}
+		// errors in main config values shared by hosts are reported once
+		for _, configErr := range validateSiteConfig(config.GetHostConfig(host), site) {
+			if !reported[configErr.Error()] {
+				reported[configErr.Error()] = true
+				errs = append(errs, configErr)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateProxyType - check proxy type is supported
+func validateProxyType(proxyType string) error {
+	switch proxyType {
+	case ProxyTypeHTTP, ProxyTypeFCGI, ProxyTypeStatic, ProxyTypeDummy:
+		{
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown proxy type '%s', expected %s, %s or %s", proxyType, ProxyTypeHTTP, ProxyTypeFCGI, ProxyTypeStatic)
+}
+
+// isValidHostName - check virtual host name, a wildcard is only allowed as
+// the first label
+func isValidHostName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/: ") {
+		return false
+	}
+	return !strings.Contains(strings.TrimPrefix(name, "*."), "*")
+}
+
+// siteSource - key path of virtual host or route and the values it sets,
+// errors in values it does not set are positioned in the enclosing config
+type siteSource struct {
+	keyPath   string
+	parent    *siteSource
+	proxyType bool
+	backend   bool
+	static    bool
+	enabled   bool
+	extConfig map[string]json.RawMessage
+	routes    bool
+}
+
+// path - get key path of value in the closest site that sets it, nil site
+// is the main config
+func (s *siteSource) path(set func(site *siteSource) bool, key string) string {
+	for site := s; site != nil; site = site.parent {
+		if set(site) {
+			return site.keyPath + "." + key
+		}
+	}
+	return key
+}
+
+// validateSiteConfig - check backends, extensions and routes requests are
+// handled with, site is nil for the main config
+func validateSiteConfig(config *Config, site *siteSource) ConfigErrors {
+	errs := ConfigErrors{}
+	fail := func(keyPath string, format string, args ...interface{}) {
+		errs = append(errs, config.source.errorFor(keyPath, fmt.Errorf(format, args...)))
+	}
+	if site != nil && site.proxyType {
+		if err := validateProxyType(config.ProxyType); err != nil {
+			fail(site.keyPath+".proxy_type", "%s", err)
+		}
+	}
+	if config.ProxyType == ProxyTypeStatic {
+		keyPath := site.path(func(site *siteSource) bool { return site.static }, "static.root")
+		if info, err := os.Stat(config.Static.Root); config.Static.Root == "" || err != nil || !info.IsDir() {
+			fail(keyPath, "static root '%s' is not a directory", config.Static.Root)
+		}
+	} else {
+		backendPrefix := site.path(func(site *siteSource) bool { return site.backend }, "")
+		for i, backend := range config.GetBackends() {
+			keyPath := backendPrefix + "backend"
+			if len(config.Backends) > 0 {
+				keyPath = backendPrefix + "backends[" + strconv.Itoa(i) + "].address"
+			}
+			if backend.Address == "" {
+				fail(keyPath, "backend address is empty")
+				continue
+			}
+			if config.ProxyType == ProxyTypeHTTP {
+				backendURL, err := url.Parse(backend.Address)
+				if err != nil || (backendURL.Scheme != "http" && backendURL.Scheme != "https") || backendURL.Host == "" {
+					fail(keyPath, "'%s' is not an http or https url", backend.Address)
+				}
+			}
+		}
+	}
+	enabledPrefix := site.path(func(site *siteSource) bool { return site.enabled }, "")
+	for i, name := range config.Extensions.Enabled {
+		keyPath := enabledPrefix + "extensions.enabled[" + strconv.Itoa(i) + "]"
+		validate, err := getExtensionValidator(config, name)
+		if err != nil {
+			fail(keyPath, "extension '%s' not found, %s", name, err)
+			continue
+		}
+		rawConfig := config.Extensions.Config[name]
+		if validate == nil {
+			continue
+		}
+		if err := validate(rawConfig); err != nil {
+			configPrefix := site.path(func(site *siteSource) bool {
+				_, ok := site.extConfig[name]
+				return ok
+			}, "")
+			errs = append(errs, extensionConfigErrors(config.source, configPrefix+"extensions.config."+name, err)...)
+		}
+	}
+	routesPrefix := site.path(func(site *siteSource) bool { return site.routes }, "")
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		routePath := routesPrefix + "routes[" + strconv.Itoa(i) + "]"
+		if route.Prefix != "" && !strings.HasPrefix(route.Prefix, "/") {
+			fail(routePath+".prefix", "prefix '%s' does not start with /", route.Prefix)
+		}
+		if _, err := regexp.Compile(route.Regex); err != nil {
+			fail(routePath+".regex", "invalid regex, %s", err)
+		}
+		for name, pattern := range route.Headers {
+			if _, err := regexp.Compile(pattern); err != nil {
+				fail(routePath+".headers."+name, "invalid regex, %s", err)
+			}
+		}
+		routeSite := &siteSource{
+			keyPath:   routePath,
+			parent:    site,
+			proxyType: route.ProxyType != "",
+			backend:   route.Backend != "" || len(route.Backends) > 0,
+			static:    route.Static.Root != "",
+			enabled:   route.Extensions.Enabled != nil,
+			extConfig: route.Extensions.Config,
+		}
+		errs = append(errs, validateSiteConfig(config.GetRouteConfig(route), routeSite)...)
+	}
+	return errs
+}
+
+// getExtensionValidator - get config validator of compiled in extension or
+// plugin, nil when extension has none, errors when extension does not exist
+func getExtensionValidator(config *Config, name string) (ExtensionValidator, error) {
+	if _, ok := getExtensionFactory(name); ok {
+		return getNativeExtensionValidator(name), nil
+	}
+	pluginPath := path.Join(config.Extensions.Path, name)
+	if _, err := os.Stat(pluginPath); err != nil {
+		return nil, err
+	}
+	return getPluginValidator(pluginPath)
+}
+
+// extensionConfigErrors - position errors returned by extension validator
+// within the config file
+func extensionConfigErrors(source *configSource, keyPath string, err error) ConfigErrors {
+	var configErrs ConfigErrors
+	var configErr *ConfigError
+	switch {
+	case errors.As(err, &configErrs):
+		break
+	case errors.As(err, &configErr):
+		{
+			configErrs = ConfigErrors{configErr}
+			break
+		}
+	default:
+		{
+			return ConfigErrors{source.errorFor(keyPath, err)}
+		}
+	}
+	out := make(ConfigErrors, 0, len(configErrs))
+	for _, e := range configErrs {
+		childPath := keyPath
+		if e.Path != "" {
+			childPath += "." + e.Path
+		}
+		base, ok := int64(0), false
+		if source != nil {
+			base, ok = source.offsets[keyPath]
+		}
+		if !ok || e.Line == 0 || source.positions != nil {
+			out = append(out, source.errorFor(childPath, e.Err))
+			continue
+		}
+		out = append(out, source.errorAt(base+e.offset, childPath, e.Err))
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorPageDefault - error pages config key used when no status code matches
+const ErrorPageDefault = "default"
+
+// defaultErrorPageTemplate - HTML for error pages
+var defaultErrorPageTemplate = template.Must(template.New("error").Parse(
+	`<!DOCTYPE html><html><head><title>Error {{.Status}}</title><meta charset="UTF-8"/><style type="text/css"> html, body{font-family: sans-serif; text-align: center; margin-top: 40px;}h1{color: #000; font-size: 36px;}p{color: #666; font-size: 12px;}</style></head><body><h1>Error {{.Status}}</h1>{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>{{end}}</body></html>`,
+))
+
+// errorPageTemplates - compiled error page templates by status code or
+// "default"
+type errorPageTemplates map[string]*template.Template
+
+// ErrorPageData - variables available to error page templates
+type ErrorPageData struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"status_text"`
+	RequestID  string `json:"request_id,omitempty"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Message    string `json:"message"`
+}
+
+// RenderErrorPage - render an error page, status code is determined by the
+// error, JSON is rendered when the client accepts it
+func RenderErrorPage(w http.ResponseWriter, r *http.Request, config *Config, err error) {
+	status := ErrorStatusCode(err)
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  r.Header.Get(RequestIDHeader),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Message:    ErrorMessage(err),
+	}
+	if rc := GetRequestContext(r); rc != nil {
+		data.RequestID = rc.ID
+	}
+	RequestLogger(r).Error("request failed", "status", status, "error", err)
+	if data.RequestID != "" {
+		w.Header().Set(RequestIDHeader, data.RequestID)
+	}
+	// json
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	// html
+	tmpl := defaultErrorPageTemplate
+	if config != nil {
+		var tmplErr error
+		tmpl, tmplErr = getErrorPageTemplate(config, status)
+		if tmplErr != nil {
+			GetLogger().Warn("error page template failed", "error", tmplErr)
+			tmpl = defaultErrorPageTemplate
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		GetLogger().Warn("error page template failed", "error", err)
+	}
+}
+
+// ErrorMessage - get message for error that is safe to show to clients
+func ErrorMessage(err error) string {
+	if errors.Is(err, ErrNoHost) {
+		return "The requested host is not served here."
+	}
+	var extErr *ExtensionError
+	if errors.As(err, &extErr) {
+		return "The request could not be processed."
+	}
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		if isTimeoutError(err) {
+			return "The application did not respond in time."
+		}
+		return "The application is unavailable."
+	}
+	return "An internal error occurred."
+}
+
+// getErrorPageTemplate - get compiled template for status code from config,
+// templates of a config that was not validated are compiled on use
+func getErrorPageTemplate(config *Config, status int) (*template.Template, error) {
+	key := strconv.Itoa(status)
+	pageConfig, ok := config.ErrorPages[key]
+	if !ok {
+		key = ErrorPageDefault
+		pageConfig, ok = config.ErrorPages[key]
+	}
+	if !ok {
+		return defaultErrorPageTemplate, nil
+	}
+	if tmpl, ok := config.errorPages[key]; ok {
+		return tmpl, nil
+	}
+	return compileErrorPageTemplate(pageConfig)
+}
+
+// compileErrorPages - compile every error page template of config by status
+// code, errors are positioned at the template or file
+func compileErrorPages(config *Config) (errorPageTemplates, ConfigErrors) {
+	keys := make([]string, 0, len(config.ErrorPages))
+	for key := range config.ErrorPages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	templates := make(errorPageTemplates, len(keys))
+	errs := ConfigErrors{}
+	for _, key := range keys {
+		pageConfig := config.ErrorPages[key]
+		tmpl, err := compileErrorPageTemplate(pageConfig)
+		if err != nil {
+			keyPath := "error_pages." + key + ".template"
+			if pageConfig.File != "" {
+				keyPath = "error_pages." + key + ".file"
+			}
+			errs = append(errs, config.source.errorFor(keyPath, err))
+			continue
+		}
+		templates[key] = tmpl
+	}
+	return templates, errs
+}
+
+// compileErrorPageTemplate - compile template from file or inline config
+func compileErrorPageTemplate(pageConfig ErrorPageConfig) (*template.Template, error) {
+	text := pageConfig.Template
+	if pageConfig.File != "" {
+		textBytes, err := ioutil.ReadFile(pageConfig.File)
+		if err != nil {
+			return nil, err
+		}
+		text = string(textBytes)
+	}
+	return template.New("error").Parse(text)
+}
+
+// acceptsJSON - determine if client prefers a JSON response over HTML by
+// quality value, the type listed first wins on equal quality
+func acceptsJSON(r *http.Request) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	jsonIndex, htmlIndex := -1, -1
+	for i, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			{
+				if q > jsonQ {
+					jsonQ, jsonIndex = q, i
+				}
+				break
+			}
+		case mediaType == "text/html" || mediaType == "text/*" || mediaType == "*/*":
+			{
+				if q > htmlQ {
+					htmlQ, htmlIndex = q, i
+				}
+				break
+			}
+		}
+	}
+	if jsonQ <= 0 {
+		return false
+	}
+	return jsonQ > htmlQ || (jsonQ == htmlQ && jsonIndex < htmlIndex)
+}
@@ -0,0 +1,92 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// BackendError - error while fetching from backend
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+// Error - get error message
+func (e *BackendError) Error() string {
+	if e.Backend == "" {
+		return fmt.Sprintf("backend, %s", e.Err.Error())
+	}
+	return fmt.Sprintf("backend %s, %s", e.Backend, e.Err.Error())
+}
+
+// Unwrap - get underlying error
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// ExtensionError - error returned by extension event
+type ExtensionError struct {
+	Extension string
+	Event     string
+	Err       error
+}
+
+// Error - get error message
+func (e *ExtensionError) Error() string {
+	return fmt.Sprintf("extension %s %s, %s", e.Extension, e.Event, e.Err.Error())
+}
+
+// Unwrap - get underlying error
+func (e *ExtensionError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorStatusCode - get http status code for error, extension failures are
+// 500, backend timeouts 504, other backend failures 502 and requests for
+// hosts that are not served 421
+func ErrorStatusCode(err error) int {
+	if errors.Is(err, ErrNoHost) {
+		return http.StatusMisdirectedRequest
+	}
+	var extErr *ExtensionError
+	if errors.As(err, &extErr) {
+		return http.StatusInternalServerError
+	}
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		if isTimeoutError(err) {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// isTimeoutError - determine if error was caused by a timeout
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
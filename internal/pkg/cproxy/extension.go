@@ -1,96 +1,324 @@
-/*
-This file is part of CProxy.
-
-CProxy is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-CProxy is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package cproxy
-
-import (
-	"log"
-	"net/http"
-	"path"
-	"plugin"
-)
-
-// Extension - cproxy extension data
-type Extension struct {
-	Name       string
-	OnUnload   func()
-	OnRequest  func(req *http.Request) (*http.Response, error)
-	OnResponse func(resp *http.Response) (*http.Response, error)
-}
-
-// LoadExtensions - load extensions and initalize
-func LoadExtensions(config *Config, subRequestCallback func(req *http.Request) (*http.Response, error)) ([]Extension, error) {
-	exts := make([]Extension, 0)
-	for _, name := range config.Extensions.Enabled {
-		plugin, err := plugin.Open(
-			path.Join(config.Extensions.Path, name),
-		)
-		if err != nil {
-			return nil, err
-		}
-		// get config
-		rawConfig := []byte{}
-		if val, ok := config.Extensions.Config[name]; ok {
-			rawConfig = val
-		}
-		// on load
-		extOnLoad, err := plugin.Lookup("OnLoad")
-		if err != nil {
-			return nil, err
-		}
-		extOnLoad.(func(subRequestCallback func(req *http.Request) (*http.Response, error), rawConfig []byte) error)(subRequestCallback, rawConfig)
-		// get name
-		extName := name
-		extGetName, err := plugin.Lookup("GetName")
-		if err == nil {
-			extName = extGetName.(func() string)()
-		}
-		log.Println("EXTENSION ::", extName, "loaded.")
-		// create ext reference
-		ext := Extension{
-			Name: extName,
-		}
-		// on unload
-		extOnUnload, err := plugin.Lookup("OnUnload")
-		if err != nil {
-			return nil, err
-		}
-		ext.OnUnload = extOnUnload.(func())
-		// on request
-		extOnRequest, err := plugin.Lookup("OnRequest")
-		if err != nil {
-			return nil, err
-		}
-		ext.OnRequest = extOnRequest.(func(req *http.Request) (*http.Response, error))
-		// on response
-		extOnResponse, err := plugin.Lookup("OnResponse")
-		if err != nil {
-			return nil, err
-		}
-		ext.OnResponse = extOnResponse.(func(resp *http.Response) (*http.Response, error))
-		// add ext to list
-		exts = append(exts, ext)
-	}
-	return exts, nil
-}
-
-// UnloadExtensions - unload all extensions
-func UnloadExtensions(exts *[]Extension) {
-	for _, ext := range *exts {
-		ext.OnUnload()
-	}
-}
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"plugin"
+	"sync"
+)
+
+// Extension - cproxy extension data
+type Extension struct {
+	Name           string
+	BufferResponse bool // needs full response body before OnResponse in stream mode
+	OnUnload       func()
+	OnRequest      func(req *http.Request) (*http.Response, error)
+	OnResponse     func(resp *http.Response) (*http.Response, error)
+	OnError        func(req *http.Request, err error) (*http.Response, error) // optional, may replace failed backend fetch
+}
+
+// SubRequestCallback - callback extensions use to make sub requests
+type SubRequestCallback = func(req *http.Request) (*http.Response, error)
+
+// ExtensionFactory - create a compiled in extension with its raw config
+type ExtensionFactory func(subRequestCallback SubRequestCallback, rawConfig []byte) (Extension, error)
+
+// ExtensionValidator - check raw extension config before the extension is
+// loaded, see ValidateExtensionConfig
+type ExtensionValidator func(rawConfig []byte) error
+
+// extensionRegistry - compiled in extensions by name
+var extensionRegistry = make(map[string]ExtensionFactory)
+
+// extensionValidators - config validators of compiled in extensions by name
+var extensionValidators = make(map[string]ExtensionValidator)
+
+// extensionRegistryMutex - guards extension registry and validators
+var extensionRegistryMutex sync.RWMutex
+
+// RegisterExtension - register a compiled in extension so it can be
+// enabled by name, intended to be called from an init function
+func RegisterExtension(name string, factory ExtensionFactory) {
+	extensionRegistryMutex.Lock()
+	defer extensionRegistryMutex.Unlock()
+	if _, exists := extensionRegistry[name]; exists {
+		panic("extension '" + name + "' registered twice")
+	}
+	extensionRegistry[name] = factory
+}
+
+// getExtensionFactory - get compiled in extension factory by name
+func getExtensionFactory(name string) (ExtensionFactory, bool) {
+	extensionRegistryMutex.RLock()
+	defer extensionRegistryMutex.RUnlock()
+	factory, ok := extensionRegistry[name]
+	return factory, ok
+}
+
+// RegisterExtensionValidator - register config validator of a compiled in
+// extension, run by ValidateConfig
+func RegisterExtensionValidator(name string, validate ExtensionValidator) {
+	extensionRegistryMutex.Lock()
+	defer extensionRegistryMutex.Unlock()
+	extensionValidators[name] = validate
+}
+
+// getNativeExtensionValidator - get config validator of compiled in extension
+func getNativeExtensionValidator(name string) ExtensionValidator {
+	extensionRegistryMutex.RLock()
+	defer extensionRegistryMutex.RUnlock()
+	return extensionValidators[name]
+}
+
+// getPluginValidator - get optional ValidateConfig function of plugin
+func getPluginValidator(pluginPath string) (ExtensionValidator, error) {
+	plugin, err := plugin.Open(pluginPath)
+	if err != nil {
+		return nil, err
+	}
+	extValidateConfig, err := plugin.Lookup("ValidateConfig")
+	if err != nil {
+		return nil, nil
+	}
+	validate, ok := extValidateConfig.(func(rawConfig []byte) error)
+	if !ok {
+		return nil, errors.New("ValidateConfig has wrong signature")
+	}
+	return validate, nil
+}
+
+// LoadExtensions - load extensions and initalize, compiled in extensions
+// take priority over plugins in the extensions path, extensions already
+// loaded are unloaded when one fails to load
+func LoadExtensions(config *Config, subRequestCallback SubRequestCallback) ([]Extension, error) {
+	exts := make([]Extension, 0)
+	for _, name := range config.Extensions.Enabled {
+		ext, err := loadExtension(config, name, subRequestCallback)
+		if err != nil {
+			UnloadExtensions(&exts)
+			return nil, err
+		}
+		// add ext to list
+		exts = append(exts, ext)
+	}
+	// built in cache goes last so it stores the final response
+	if config.Cache.Enabled {
+		ext, err := NewCacheExtension(config, subRequestCallback)
+		if err != nil {
+			UnloadExtensions(&exts)
+			return nil, err
+		}
+		GetLogger().Info("extension loaded", "extension", ext.Name)
+		exts = append(exts, ext)
+	}
+	return exts, nil
+}
+
+// reloadExtensions - load extensions for new config, extensions that are
+// still enabled with unchanged config are kept, returns the extensions of
+// the old chain that are no longer used so they can be unloaded once in-flight
+// requests are done, newly loaded extensions are added to loaded so the
+// caller can unload them on error
+func reloadExtensions(config *Config, oldConfig *Config, oldExts []Extension, subRequestCallback SubRequestCallback, loaded *[]Extension) ([]Extension, []Extension, error) {
+	// old chain is in order of enabled names with the cache last
+	old := make(map[string]Extension)
+	for i, name := range oldConfig.Extensions.Enabled {
+		old[name] = oldExts[i]
+	}
+	kept := make(map[string]bool)
+	exts := make([]Extension, 0)
+	for _, name := range config.Extensions.Enabled {
+		if ext, ok := old[name]; ok && !kept[name] {
+			sameConfig := bytes.Equal(config.Extensions.Config[name], oldConfig.Extensions.Config[name])
+			_, native := getExtensionFactory(name)
+			if sameConfig || !native {
+				if !sameConfig {
+					// plugins are opened once per process and can not be loaded again
+					GetLogger().Warn("plugin extension config changed, restart to apply", "extension", name)
+				}
+				kept[name] = true
+				exts = append(exts, ext)
+				continue
+			}
+		}
+		ext, err := loadExtension(config, name, subRequestCallback)
+		if err != nil {
+			return nil, nil, err
+		}
+		*loaded = append(*loaded, ext)
+		exts = append(exts, ext)
+	}
+	removed := make([]Extension, 0)
+	for i, name := range oldConfig.Extensions.Enabled {
+		if !kept[name] {
+			removed = append(removed, oldExts[i])
+		}
+	}
+	// cache is kept with its contents unless its config changed
+	var oldCache *Extension
+	if oldConfig.Cache.Enabled {
+		oldCache = &oldExts[len(oldConfig.Extensions.Enabled)]
+	}
+	cacheConfig, _ := json.Marshal(config.Cache)
+	oldCacheConfig, _ := json.Marshal(oldConfig.Cache)
+	switch {
+	case config.Cache.Enabled && oldCache != nil && bytes.Equal(cacheConfig, oldCacheConfig):
+		{
+			exts = append(exts, *oldCache)
+			break
+		}
+	case config.Cache.Enabled:
+		{
+			ext, err := NewCacheExtension(config, subRequestCallback)
+			if err != nil {
+				return nil, nil, err
+			}
+			GetLogger().Info("extension loaded", "extension", ext.Name)
+			*loaded = append(*loaded, ext)
+			exts = append(exts, ext)
+			if oldCache != nil {
+				removed = append(removed, *oldCache)
+			}
+			break
+		}
+	case oldCache != nil:
+		{
+			removed = append(removed, *oldCache)
+			break
+		}
+	}
+	return exts, removed, nil
+}
+
+// loadExtension - load enabled extension by name
+func loadExtension(config *Config, name string, subRequestCallback SubRequestCallback) (Extension, error) {
+	// get config
+	rawConfig := []byte{}
+	if val, ok := config.Extensions.Config[name]; ok {
+		rawConfig = val
+	}
+	var ext Extension
+	var err error
+	if factory, ok := getExtensionFactory(name); ok {
+		ext, err = loadNativeExtension(name, factory, subRequestCallback, rawConfig)
+	} else {
+		ext, err = loadPluginExtension(config, name, subRequestCallback, rawConfig)
+	}
+	if err != nil {
+		return Extension{}, err
+	}
+	GetLogger().Info("extension loaded", "extension", ext.Name)
+	return ext, nil
+}
+
+// loadNativeExtension - initalize compiled in extension
+func loadNativeExtension(name string, factory ExtensionFactory, subRequestCallback SubRequestCallback, rawConfig []byte) (Extension, error) {
+	ext, err := factory(subRequestCallback, rawConfig)
+	if err != nil {
+		return Extension{}, err
+	}
+	if ext.Name == "" {
+		ext.Name = name
+	}
+	// optional events
+	if ext.OnUnload == nil {
+		ext.OnUnload = func() {}
+	}
+	if ext.OnRequest == nil {
+		ext.OnRequest = func(req *http.Request) (*http.Response, error) { return nil, nil }
+	}
+	if ext.OnResponse == nil {
+		ext.OnResponse = func(resp *http.Response) (*http.Response, error) { return resp, nil }
+	}
+	return ext, nil
+}
+
+// loadPluginExtension - open plugin from extensions path and initalize
+func loadPluginExtension(config *Config, name string, subRequestCallback SubRequestCallback, rawConfig []byte) (Extension, error) {
+	plugin, err := plugin.Open(
+		path.Join(config.Extensions.Path, name),
+	)
+	if err != nil {
+		return Extension{}, err
+	}
+	// on load
+	extOnLoad, err := plugin.Lookup("OnLoad")
+	if err != nil {
+		return Extension{}, err
+	}
+	err = extOnLoad.(func(subRequestCallback func(req *http.Request) (*http.Response, error), rawConfig []byte) error)(subRequestCallback, rawConfig)
+	if err != nil {
+		return Extension{}, err
+	}
+	// get name
+	extName := name
+	extGetName, err := plugin.Lookup("GetName")
+	if err == nil {
+		extName = extGetName.(func() string)()
+	}
+	// create ext reference
+	ext := Extension{
+		Name: extName,
+	}
+	// on unload
+	extOnUnload, err := plugin.Lookup("OnUnload")
+	if err != nil {
+		return Extension{}, err
+	}
+	ext.OnUnload = extOnUnload.(func())
+	// on request
+	extOnRequest, err := plugin.Lookup("OnRequest")
+	if err != nil {
+		return Extension{}, err
+	}
+	ext.OnRequest = extOnRequest.(func(req *http.Request) (*http.Response, error))
+	// on response
+	extOnResponse, err := plugin.Lookup("OnResponse")
+	if err != nil {
+		return Extension{}, err
+	}
+	ext.OnResponse = extOnResponse.(func(resp *http.Response) (*http.Response, error))
+	// on error (optional)
+	extOnError, err := plugin.Lookup("OnError")
+	if err == nil {
+		ext.OnError = extOnError.(func(req *http.Request, err error) (*http.Response, error))
+	}
+	// buffer response (optional)
+	extBufferResponse, err := plugin.Lookup("BufferResponse")
+	if err == nil {
+		ext.BufferResponse = extBufferResponse.(func() bool)()
+	}
+	return ext, nil
+}
+
+// UnloadExtensions - unload all extensions in reverse load order
+func UnloadExtensions(exts *[]Extension) {
+	for i := len(*exts) - 1; i >= 0; i-- {
+		ext := (*exts)[i]
+		if ext.OnUnload == nil {
+			continue
+		}
+		GetLogger().Info("extension unloaded", "extension", ext.Name)
+		ext.OnUnload()
+	}
+}
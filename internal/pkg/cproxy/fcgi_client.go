@@ -0,0 +1,303 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastCGI record types and flags
+const (
+	fcgiVersion1      = 1
+	fcgiBeginRequest  = 1
+	fcgiEndRequest    = 3
+	fcgiParams        = 4
+	fcgiStdin         = 5
+	fcgiStdout        = 6
+	fcgiStderr        = 7
+	fcgiRoleResponder = 1
+	fcgiFlagKeepConn  = 1
+	fcgiRequestID     = 1
+	fcgiMaxContentLen = 65535
+)
+
+// fcgiHeader - FastCGI record header
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	ID            uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// fcgiConn - connection to a FastCGI backend, one request at a time
+type fcgiConn struct {
+	pool     *fcgiPool
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	lastUsed time.Time
+	reused   bool
+}
+
+// newFCGIConn - wrap network connection
+func newFCGIConn(pool *fcgiPool, conn net.Conn) *fcgiConn {
+	return &fcgiConn{
+		pool:   pool,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// writeRecord - write a single record, content must fit in one record
+func (c *fcgiConn) writeRecord(recType uint8, content []byte) error {
+	padding := uint8(-len(content) & 7)
+	err := binary.Write(c.writer, binary.BigEndian, fcgiHeader{
+		Version:       fcgiVersion1,
+		Type:          recType,
+		ID:            fcgiRequestID,
+		ContentLength: uint16(len(content)),
+		PaddingLength: padding,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(content); err != nil {
+		return err
+	}
+	_, err = c.writer.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream - write stream as records followed by an empty record
+func (c *fcgiConn) writeStream(recType uint8, r io.Reader) error {
+	if r != nil {
+		buf := make([]byte, fcgiMaxContentLen)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if err := c.writeRecord(recType, buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return c.writeRecord(recType, nil)
+}
+
+// readRecord - read next record
+func (c *fcgiConn) readRecord() (fcgiHeader, []byte, error) {
+	h := fcgiHeader{}
+	if err := binary.Read(c.reader, binary.BigEndian, &h); err != nil {
+		return h, nil, err
+	}
+	if h.Version != fcgiVersion1 {
+		return h, nil, errors.New("fcgi, invalid record version")
+	}
+	content := make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+	if _, err := io.ReadFull(c.reader, content); err != nil {
+		return h, nil, err
+	}
+	return h, content[:h.ContentLength], nil
+}
+
+// request - send request and parse CGI response headers, body is read
+// from the connection as it is consumed
+func (c *fcgiConn) request(params map[string]string, body io.Reader, keepConn bool) (*http.Response, error) {
+	// begin request
+	flags := uint8(0)
+	if keepConn {
+		flags = fcgiFlagKeepConn
+	}
+	if err := c.writeRecord(fcgiBeginRequest, []byte{0, fcgiRoleResponder, flags, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	// params
+	if err := c.writeStream(fcgiParams, encodeFCGIParams(params)); err != nil {
+		return nil, err
+	}
+	// stdin
+	if err := c.writeStream(fcgiStdin, body); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	// read CGI headers from stdout
+	stdout := &fcgiStdoutReader{conn: c}
+	bodyReader := bufio.NewReader(stdout)
+	mimeHeader, err := textproto.NewReader(bodyReader).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && stdout.done) {
+		return nil, err
+	}
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(mimeHeader),
+		ContentLength: -1,
+		Body:          &fcgiBody{reader: bodyReader, stdout: stdout},
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	// status header, CGI redirects default to 302
+	if status := resp.Header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("fcgi, invalid status '%s'", status)
+		}
+		resp.StatusCode = code
+		resp.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+		resp.Header.Del("Status")
+	} else if resp.Header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+		resp.Status = "302 Found"
+	}
+	if contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = contentLength
+	}
+	return resp, nil
+}
+
+// alive - check idle connection has not been closed by the backend
+func (c *fcgiConn) alive() bool {
+	if c.reader.Buffered() > 0 {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.reader.Peek(1)
+	c.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// fcgiStdoutReader - reads stdout records until the request ends
+type fcgiStdoutReader struct {
+	conn *fcgiConn
+	buf  []byte
+	done bool
+	err  error
+}
+
+// Read - read stdout content
+func (r *fcgiStdoutReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		h, content, err := r.conn.readRecord()
+		if err != nil {
+			r.err = err
+			continue
+		}
+		switch h.Type {
+		case fcgiStdout:
+			{
+				r.buf = content
+				break
+			}
+		case fcgiStderr:
+			{
+				if len(content) > 0 {
+					GetLogger().Warn("fcgi stderr", "backend", r.conn.pool.address, "output", strings.TrimSpace(string(content)))
+				}
+				break
+			}
+		case fcgiEndRequest:
+			{
+				r.done = true
+				// protocol status, request was rejected by the backend
+				if len(content) >= 5 && content[4] != 0 {
+					r.err = fmt.Errorf("fcgi, request rejected with protocol status %d", content[4])
+				}
+				break
+			}
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fcgiBody - response body, connection is returned to the pool on close
+// when the response was fully read
+type fcgiBody struct {
+	reader *bufio.Reader
+	stdout *fcgiStdoutReader
+	closed bool
+}
+
+// Read - read response body
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// Close - release connection
+func (b *fcgiBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	conn := b.stdout.conn
+	conn.pool.release(conn, b.stdout.done && b.stdout.err == nil)
+	return nil
+}
+
+// encodeFCGIParams - encode params as name-value pairs
+func encodeFCGIParams(params map[string]string) io.Reader {
+	buf := make([]byte, 0, 1024)
+	for name, value := range params {
+		buf = appendFCGILength(buf, len(name))
+		buf = appendFCGILength(buf, len(value))
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	return strings.NewReader(string(buf))
+}
+
+// appendFCGILength - append name-value pair length
+func appendFCGILength(buf []byte, length int) []byte {
+	if length < 128 {
+		return append(buf, byte(length))
+	}
+	return append(buf, byte(length>>24)|0x80, byte(length>>16), byte(length>>8), byte(length))
+}
@@ -0,0 +1,278 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fcgiAliveCheckAfter - idle time after which a connection is checked before reuse
+const fcgiAliveCheckAfter = time.Second
+
+// fcgiPoolKey - identifies a connection pool
+type fcgiPoolKey struct {
+	address string
+	config  FCGIConfig
+}
+
+// fcgiPools - connection pools by backend and settings
+var fcgiPools = make(map[fcgiPoolKey]*fcgiPool)
+
+// fcgiPoolsMutex - guards fcgi pools
+var fcgiPoolsMutex sync.Mutex
+
+// fcgiPool - pool of keep-alive connections to a FastCGI backend
+type fcgiPool struct {
+	network   string
+	address   string
+	config    FCGIConfig
+	mutex     sync.Mutex
+	idle      []*fcgiConn
+	open      int
+	slots     chan struct{} // held by every open connection, nil when unlimited
+	idleReady chan struct{} // signals waiters that a connection became idle
+	closed    bool          // removed from pools, connections are not kept idle
+}
+
+// FCGIPoolStats - connection pool statistics
+type FCGIPoolStats struct {
+	Address string `json:"address"`
+	Open    int    `json:"open"`
+	Idle    int    `json:"idle"`
+}
+
+// getFCGIPool - get shared connection pool for backend
+func getFCGIPool(address string, config *FCGIConfig) *fcgiPool {
+	key := fcgiPoolKey{address: address, config: *config}
+	fcgiPoolsMutex.Lock()
+	defer fcgiPoolsMutex.Unlock()
+	if pool, ok := fcgiPools[key]; ok {
+		return pool
+	}
+	pool := &fcgiPool{
+		network: "tcp",
+		address: strings.TrimPrefix(address, "unix:"),
+		config:  *config,
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		pool.network = "unix"
+	}
+	if config.MaxOpenConns > 0 {
+		pool.slots = make(chan struct{}, config.MaxOpenConns)
+		pool.idleReady = make(chan struct{}, 1)
+	}
+	fcgiPools[key] = pool
+	return pool
+}
+
+// pruneFCGIPools - close idle connections of and remove connection pools
+// none of the configs use
+func pruneFCGIPools(configs []*Config) {
+	used := make(map[fcgiPoolKey]bool)
+	for _, config := range configs {
+		for _, backendConfig := range config.GetBackends() {
+			used[fcgiPoolKey{address: backendConfig.Address, config: config.FCGI}] = true
+		}
+	}
+	fcgiPoolsMutex.Lock()
+	defer fcgiPoolsMutex.Unlock()
+	for key, pool := range fcgiPools {
+		if !used[key] {
+			pool.close()
+			delete(fcgiPools, key)
+		}
+	}
+}
+
+// close - close idle connections, connections in use are closed when
+// released
+func (p *fcgiPool) close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mutex.Unlock()
+	for _, conn := range idle {
+		p.closeConn(conn)
+	}
+}
+
+// GetFCGIPoolStats - get statistics for all FastCGI connection pools
+func GetFCGIPoolStats() []FCGIPoolStats {
+	fcgiPoolsMutex.Lock()
+	pools := make([]*fcgiPool, 0, len(fcgiPools))
+	for _, pool := range fcgiPools {
+		pools = append(pools, pool)
+	}
+	fcgiPoolsMutex.Unlock()
+	stats := make([]FCGIPoolStats, 0, len(pools))
+	for _, pool := range pools {
+		pool.mutex.Lock()
+		stats = append(stats, FCGIPoolStats{
+			Address: pool.address,
+			Open:    pool.open,
+			Idle:    len(pool.idle),
+		})
+		pool.mutex.Unlock()
+	}
+	return stats
+}
+
+// get - get idle connection or dial a new one, waits for a connection
+// to become available when max open connections is reached
+func (p *fcgiPool) get(ctx context.Context) (*fcgiConn, error) {
+	for {
+		// reuse idle connection
+		if conn := p.popIdle(); conn != nil {
+			idleTime := time.Since(conn.lastUsed)
+			if (p.config.IdleTimeout > 0 && idleTime > time.Duration(p.config.IdleTimeout)) ||
+				(idleTime > fcgiAliveCheckAfter && !conn.alive()) {
+				p.closeConn(conn)
+				continue
+			}
+			conn.reused = true
+			return conn, nil
+		}
+		// open new connection
+		if p.slots == nil {
+			break
+		}
+		select {
+		case p.slots <- struct{}{}:
+			{
+				return p.dial(ctx)
+			}
+		case <-p.idleReady:
+			{
+				continue
+			}
+		case <-ctx.Done():
+			{
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return p.dial(ctx)
+}
+
+// popIdle - take most recently used idle connection
+func (p *fcgiPool) popIdle() *fcgiConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	conn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return conn
+}
+
+// dial - open new connection, caller holds a slot
+func (p *fcgiPool) dial(ctx context.Context) (*fcgiConn, error) {
+	dialer := net.Dialer{Timeout: time.Duration(p.config.DialTimeout)}
+	netConn, err := dialer.DialContext(ctx, p.network, p.address)
+	if err != nil {
+		p.freeSlot()
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.open++
+	p.mutex.Unlock()
+	return newFCGIConn(p, netConn), nil
+}
+
+// release - return connection to the pool, or close it when it can not be reused
+func (p *fcgiPool) release(conn *fcgiConn, reusable bool) {
+	conn.conn.SetDeadline(time.Time{})
+	conn.lastUsed = time.Now()
+	p.mutex.Lock()
+	if reusable && !p.closed && len(p.idle) < p.config.MaxIdleConns {
+		p.idle = append(p.idle, conn)
+		p.mutex.Unlock()
+		if p.idleReady != nil {
+			select {
+			case p.idleReady <- struct{}{}:
+			default:
+			}
+		}
+		return
+	}
+	p.mutex.Unlock()
+	p.closeConn(conn)
+}
+
+// closeConn - close connection and free its slot
+func (p *fcgiPool) closeConn(conn *fcgiConn) {
+	conn.conn.Close()
+	p.mutex.Lock()
+	p.open--
+	p.mutex.Unlock()
+	p.freeSlot()
+}
+
+// freeSlot - allow another connection to be opened
+func (p *fcgiPool) freeSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// do - send request over a pooled connection, request is retried on a new
+// connection when a reused one turns out to be closed before the body is sent
+func (p *fcgiPool) do(req *http.Request, params map[string]string) (*http.Response, error) {
+	for {
+		conn, err := p.get(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := req.Context().Deadline(); ok {
+			conn.conn.SetDeadline(deadline)
+		}
+		body := &readTracker{Reader: req.Body}
+		resp, err := conn.request(params, body, p.config.MaxIdleConns > 0)
+		if err != nil {
+			p.closeConn(conn)
+			if conn.reused && !body.read {
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// readTracker - reader that records whether it has been read from
+type readTracker struct {
+	io.Reader
+	read bool
+}
+
+// Read - read and record
+func (r *readTracker) Read(p []byte) (int, error) {
+	if r.Reader == nil {
+		return 0, io.EOF
+	}
+	r.read = true
+	return r.Reader.Read(p)
+}
@@ -1,175 +1,270 @@
-/*
-This file is part of CProxy.
-
-CProxy is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-CProxy is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package cproxy
-
-import (
-	"bufio"
-	"bytes"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/http/fcgi"
-	"net/url"
-	"strconv"
-	"strings"
-
-	fcgiclient "github.com/alash3al/go-fastcgi-client"
-)
-
-// BackendFetch - fetch content from backend
-func BackendFetch(req *http.Request, config *Config) (*http.Response, error) {
-	switch config.ProxyType {
-	case ProxyTypeHTTP:
-		{
-			return httpBackendFetch(req, config)
-		}
-	case ProxyTypeFCGI:
-		{
-			return fcgiBackendFetch(req, config)
-		}
-	case ProxyTypeDummy:
-		{
-			return dummyBackendFetch(req, config)
-		}
-	}
-	return nil, fmt.Errorf("no fetcher found for proxy type '%s'", config.ProxyType)
-}
-
-// httpBackendFetch - fetch content from http backend
-func httpBackendFetch(req *http.Request, config *Config) (*http.Response, error) {
-	connectURL, err := url.Parse(config.Backend)
-	if err != nil {
-		return nil, err
-	}
-	req.Host = connectURL.Host
-	req.URL.Scheme = connectURL.Scheme
-	req.URL.Host = connectURL.Host
-	httpConn := http.Client{}
-	req.RequestURI = ""
-	oResp, err := httpConn.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	// read response
-	// read now so network connection can be closed
-	buf := bytes.NewBuffer(nil)
-	bufW := bufio.NewWriter(buf)
-	oResp.Write(bufW)
-	bufW.Flush()
-	// close the original response
-	oResp.Body.Close()
-	respBytes := buf.Bytes()
-	resp, err := http.ReadResponse(
-		bufio.NewReader(bytes.NewReader(respBytes)),
-		req,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
-}
-
-// fcgiBackendFetch - fetch content from fcgi backend
-func fcgiBackendFetch(req *http.Request, config *Config) (*http.Response, error) {
-	p := GetFCGIEnvVars(req, config)
-	// open connection to backend
-	fcgiConn, err := fcgiclient.Dial("tcp", config.Backend)
-	if err != nil {
-		fcgiConn, err = fcgiclient.Dial("unix", config.Backend)
-		if err != nil {
-			return nil, err
-		}
-	}
-	defer fcgiConn.Close()
-	// send request
-	oResp, err := fcgiConn.Request(p, req.Body)
-	if err != nil {
-		return nil, err
-	}
-	// read response
-	// read now so network connection can be closed
-	buf := bytes.NewBuffer(nil)
-	bufW := bufio.NewWriter(buf)
-	oResp.Write(bufW)
-	bufW.Flush()
-	// close the original response
-	oResp.Body.Close()
-	respBytes := buf.Bytes()
-	resp, err := http.ReadResponse(
-		bufio.NewReader(bytes.NewReader(respBytes)),
-		req,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
-}
-
-// dummyBackendFetch - dummy fetch function used for testing
-func dummyBackendFetch(req *http.Request, config *Config) (*http.Response, error) {
-	p := GetFCGIEnvVars(req, config)
-	resp := &http.Response{
-		Status:     "200 OK",
-		StatusCode: http.StatusOK,
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Request:    req,
-		Header:     make(http.Header, 0),
-	}
-	resp.Header.Add("Content-Type", "text/plain")
-	// create a body of FCGI vars
-	bodyBytes := make([]byte, 0)
-	for key, val := range p {
-		bodyBytes = append(
-			bodyBytes,
-			[]byte(key+"="+val+"\n")...,
-		)
-	}
-	reader := bytes.NewReader(bodyBytes)
-	resp.Body = ioutil.NopCloser(reader)
-	resp.ContentLength = int64(len(bodyBytes))
-	return resp, nil
-}
-
-// GetFCGIEnvVars - retrieve FCGI env vars
-func GetFCGIEnvVars(req *http.Request, config *Config) map[string]string {
-	p := fcgi.ProcessEnv(req)
-	if p == nil {
-		p = map[string]string{}
-	}
-	p["SERVER_SOFTWARE"] = "go"
-	p["SERVER_NAME"] = req.Host
-	p["SERVER_PROTOCOL"] = "HTTP/1.1"
-	p["HTTP_HOST"] = req.Host
-	p["GATEWAY_INTERFACE"] = "CGI/1.1"
-	p["REQUEST_METHOD"] = req.Method
-	p["QUERY_STRING"] = req.URL.RawQuery
-	p["REQUEST_URI"] = req.URL.RequestURI()
-	p["PATH_INFO"] = req.URL.Path
-	//p["SCRIPT_NAME"] = "/"
-	//p["SCRIPT_FILENAME"] = h.Path
-	p["SERVER_PORT"] = req.URL.Port()
-	p["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
-	p["CONTENT_TYPE"] = req.Header.Get("Content-Type")
-	for k, values := range req.Header {
-		k = "HTTP_" + strings.Replace(strings.ToUpper(k), "-", "_", -1)
-		p[k] = values[0]
-	}
-	return p
-}
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/fcgi"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackendFetch - fetch content from a backend selected by the balancer,
+// failed idempotent requests are retried on another backend, static proxy
+// type serves files from disk instead
+func BackendFetch(req *http.Request, config *Config) (*http.Response, error) {
+	if config.ProxyType == ProxyTypeStatic {
+		return staticFetch(req, config)
+	}
+	if config.Timeout <= 0 {
+		return backendFetchRetry(req, config)
+	}
+	// timeout covers every attempt and reading the body in stream mode
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(config.Timeout))
+	resp, err := backendFetchRetry(req.WithContext(ctx), config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &closeFuncBody{ReadCloser: resp.Body, closeFunc: cancel}
+	return resp, nil
+}
+
+// backendFetchRetry - fetch content from backend, retried as configured
+func backendFetchRetry(req *http.Request, config *Config) (*http.Response, error) {
+	maxAttempts := 1
+	var bodyBytes []byte
+	if config.Retry.MaxAttempts > 1 && isRetryableMethod(&config.Retry, req.Method) {
+		// request body must be buffered to be sent again
+		var replayable bool
+		var err error
+		bodyBytes, replayable, err = bufferRequestBody(req, config.Retry.MaxBodySize)
+		if err != nil {
+			return nil, &BackendError{Err: err}
+		}
+		if replayable {
+			maxAttempts = config.Retry.MaxAttempts
+		}
+	}
+	tried := make(map[*Backend]bool)
+	for attempt := 1; ; attempt++ {
+		backend, err := SelectBackend(req, config, tried)
+		if errors.Is(err, ErrNoBackend) && len(tried) > 0 {
+			// every backend has been tried, start over
+			tried = make(map[*Backend]bool)
+			backend, err = SelectBackend(req, config, tried)
+		}
+		if err != nil {
+			return nil, &BackendError{Err: err}
+		}
+		tried[backend] = true
+		replayRequestBody(req, bodyBytes)
+		resp, err := BackendFetchFrom(req, config, backend)
+		if attempt >= maxAttempts || !shouldRetry(&config.Retry, req, resp, err) {
+			return resp, err
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		delay := retryBackoff(&config.Retry, attempt)
+		RequestLogger(req).Warn("retry backend fetch", "attempt", attempt, "max_retries", maxAttempts-1, "delay", delay, "backend", backend.Address, "reason", reason)
+		select {
+		case <-req.Context().Done():
+			{
+				return nil, &BackendError{Backend: backend.Address, Err: req.Context().Err()}
+			}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// BackendFetchFrom - fetch content from given backend, errors are returned as *BackendError
+func BackendFetchFrom(req *http.Request, config *Config, backend *Backend) (*http.Response, error) {
+	if rc := GetRequestContext(req); rc != nil {
+		rc.Set(RequestContextUpstream, backend.Address)
+	}
+	// backend continues the trace as a child of the fetch span, the header is
+	// set on the outgoing request only so the client's traceparent is kept
+	span := startSpan(req, "BackendFetch", spanKindClient)
+	span.SetAttribute("cproxy.backend", backend.Address)
+	outReq := req
+	if span != nil {
+		outReq = req.WithContext(req.Context())
+		outReq.Header = req.Header.Clone()
+		outReq.Header.Set(TraceParentHeader, span.TraceParent())
+	}
+	defer span.End()
+	backend.acquire()
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	switch config.ProxyType {
+	case ProxyTypeHTTP:
+		{
+			resp, err = httpBackendFetch(outReq, config, backend.Address)
+			break
+		}
+	case ProxyTypeFCGI:
+		{
+			resp, err = fcgiBackendFetch(outReq, config, backend.Address)
+			break
+		}
+	case ProxyTypeDummy:
+		{
+			resp, err = dummyBackendFetch(outReq, config)
+			break
+		}
+	default:
+		{
+			err = fmt.Errorf("no fetcher found for proxy type '%s'", config.ProxyType)
+			break
+		}
+	}
+	backendDuration.observe(time.Since(start).Seconds(), backend.Address)
+	if err != nil {
+		backend.release()
+		backendErrorsTotal.add(1, backend.Address)
+		backend.reportResult(&config.HealthCheck, err, 0)
+		span.SetError(err)
+		return nil, &BackendError{Backend: backend.Address, Err: err}
+	}
+	backend.reportResult(&config.HealthCheck, nil, resp.StatusCode)
+	span.SetStatusCode(resp.StatusCode)
+	if resp.Request == outReq {
+		resp.Request = req
+	}
+	// in stream mode the backend is in use until the body is closed
+	if config.StreamResponse {
+		resp.Body = &closeFuncBody{ReadCloser: resp.Body, closeFunc: backend.release}
+		return resp, nil
+	}
+	backend.release()
+	return resp, nil
+}
+
+// httpBackendFetch - fetch content from http backend
+func httpBackendFetch(req *http.Request, config *Config, address string) (*http.Response, error) {
+	connectURL, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	httpConn, err := getHTTPClient(&config.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	// backend address is set on a copy, retries, the cache and the access
+	// log read the client request after the fetch
+	outReq := req.Clone(req.Context())
+	outReq.Host = connectURL.Host
+	outReq.URL.Scheme = connectURL.Scheme
+	outReq.URL.Host = connectURL.Host
+	outReq.RequestURI = ""
+	oResp, err := httpConn.Do(outReq)
+	if err != nil {
+		return nil, err
+	}
+	// stream mode, body is read from the network connection as it arrives
+	if config.StreamResponse {
+		oResp.Request = req
+		return oResp, nil
+	}
+	return BufferResponse(oResp, req)
+}
+
+// fcgiBackendFetch - fetch content from fcgi backend
+func fcgiBackendFetch(req *http.Request, config *Config, address string) (*http.Response, error) {
+	p := GetFCGIEnvVars(req, config)
+	// send request over pooled connection
+	resp, err := getFCGIPool(address, &config.FCGI).do(req, p)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	// stream mode, connection is released once the body is closed
+	if config.StreamResponse {
+		return resp, nil
+	}
+	return BufferResponse(resp, req)
+}
+
+// dummyBackendFetch - dummy fetch function used for testing
+func dummyBackendFetch(req *http.Request, config *Config) (*http.Response, error) {
+	p := GetFCGIEnvVars(req, config)
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     make(http.Header, 0),
+	}
+	resp.Header.Add("Content-Type", "text/plain")
+	// create a body of FCGI vars
+	bodyBytes := make([]byte, 0)
+	for key, val := range p {
+		bodyBytes = append(
+			bodyBytes,
+			[]byte(key+"="+val+"\n")...,
+		)
+	}
+	reader := bytes.NewReader(bodyBytes)
+	resp.Body = ioutil.NopCloser(reader)
+	resp.ContentLength = int64(len(bodyBytes))
+	return resp, nil
+}
+
+// GetFCGIEnvVars - retrieve FCGI env vars
+func GetFCGIEnvVars(req *http.Request, config *Config) map[string]string {
+	p := fcgi.ProcessEnv(req)
+	if p == nil {
+		p = map[string]string{}
+	}
+	p["SERVER_SOFTWARE"] = "go"
+	p["SERVER_NAME"] = req.Host
+	p["SERVER_PROTOCOL"] = "HTTP/1.1"
+	p["HTTP_HOST"] = req.Host
+	p["GATEWAY_INTERFACE"] = "CGI/1.1"
+	p["REQUEST_METHOD"] = req.Method
+	p["QUERY_STRING"] = req.URL.RawQuery
+	p["REQUEST_URI"] = req.URL.RequestURI()
+	p["PATH_INFO"] = req.URL.Path
+	//p["SCRIPT_NAME"] = "/"
+	//p["SCRIPT_FILENAME"] = h.Path
+	p["SERVER_PORT"] = req.URL.Port()
+	p["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	p["CONTENT_TYPE"] = req.Header.Get("Content-Type")
+	for k, values := range req.Header {
+		k = "HTTP_" + strings.Replace(strings.ToUpper(k), "-", "_", -1)
+		p[k] = values[0]
+	}
+	return p
+}
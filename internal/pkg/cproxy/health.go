@@ -0,0 +1,234 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthCheckUserAgent - user agent sent with active health checks
+const healthCheckUserAgent = AppName + " health check"
+
+// backendHealth - health state of a backend
+type backendHealth struct {
+	mutex        sync.Mutex
+	checkFailed  bool      // ejected by active checks
+	ejectedUntil time.Time // ejected by passive checks
+	checkPasses  int
+	checkFails   int
+	failures     int // consecutive failed requests
+	lastError    string
+	lastCheck    time.Time
+}
+
+// BackendHealth - backend health status
+type BackendHealth struct {
+	Address     string    `json:"address"`
+	Healthy     bool      `json:"healthy"`
+	ActiveConns int64     `json:"active_conns"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastCheck   time.Time `json:"last_check"`
+}
+
+// Healthy - determine if backend is in rotation
+func (b *Backend) Healthy() bool {
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+	return !b.health.checkFailed && !time.Now().Before(b.health.ejectedUntil)
+}
+
+// Health - get backend health status
+func (b *Backend) Health() BackendHealth {
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+	return BackendHealth{
+		Address:     b.Address,
+		Healthy:     !b.health.checkFailed && !time.Now().Before(b.health.ejectedUntil),
+		ActiveConns: b.ActiveConns(),
+		Failures:    b.health.failures,
+		LastError:   b.health.lastError,
+		LastCheck:   b.health.lastCheck,
+	}
+}
+
+// GetBackendHealth - get health status of all known backends
+func GetBackendHealth() []BackendHealth {
+	backendsMutex.Lock()
+	list := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		list = append(list, backend)
+	}
+	backendsMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+	health := make([]BackendHealth, 0, len(list))
+	for _, backend := range list {
+		health = append(health, backend.Health())
+	}
+	return health
+}
+
+// reportResult - passive check, record outcome of a proxied request, backend
+// is ejected after too many consecutive errors or 5xx responses
+func (b *Backend) reportResult(config *HealthCheckConfig, err error, statusCode int) {
+	if config.MaxFailures <= 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+	if err == nil && statusCode < http.StatusInternalServerError {
+		b.health.failures = 0
+		return
+	}
+	b.health.failures++
+	if err != nil {
+		b.health.lastError = err.Error()
+	} else {
+		b.health.lastError = fmt.Sprintf("status %d", statusCode)
+	}
+	if b.health.failures >= config.MaxFailures {
+		b.health.failures = 0
+		b.health.ejectedUntil = time.Now().Add(time.Duration(config.EjectionTime))
+		GetLogger().Warn("backend ejected", "backend", b.Address, "duration", time.Duration(config.EjectionTime), "error", b.health.lastError)
+	}
+}
+
+// reportCheck - record outcome of an active health check
+func (b *Backend) reportCheck(config *HealthCheckConfig, err error) {
+	b.health.mutex.Lock()
+	defer b.health.mutex.Unlock()
+	b.health.lastCheck = time.Now()
+	if err == nil {
+		b.health.checkFails = 0
+		b.health.checkPasses++
+		if b.health.checkFailed && b.health.checkPasses >= config.HealthyThreshold {
+			b.health.checkFailed = false
+			GetLogger().Info("backend healthy", "backend", b.Address)
+		}
+		return
+	}
+	b.health.lastError = err.Error()
+	b.health.checkPasses = 0
+	b.health.checkFails++
+	if !b.health.checkFailed && b.health.checkFails >= config.UnhealthyThreshold {
+		b.health.checkFailed = true
+		GetLogger().Warn("backend unhealthy", "backend", b.Address, "error", err)
+	}
+}
+
+// StartHealthChecks - start active health checks for configured backends,
+// including those of virtual hosts, returns function that stops them
+func StartHealthChecks(config *Config) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	checked := make(map[string]bool)
+	for _, siteConfig := range config.getSiteConfigs() {
+		if siteConfig.HealthCheck.Interval <= 0 || siteConfig.ProxyType == ProxyTypeDummy || siteConfig.ProxyType == ProxyTypeStatic {
+			continue
+		}
+		for _, backendConfig := range siteConfig.GetBackends() {
+			// backends shared by virtual hosts are checked once
+			if checked[backendConfig.Address] {
+				continue
+			}
+			checked[backendConfig.Address] = true
+			wg.Add(1)
+			go runHealthCheck(ctx, &wg, siteConfig, getBackend(backendConfig.Address))
+		}
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// runHealthCheck - check backend every interval until context is done
+func runHealthCheck(ctx context.Context, wg *sync.WaitGroup, config *Config, backend *Backend) {
+	defer wg.Done()
+	ticker := time.NewTicker(time.Duration(config.HealthCheck.Interval))
+	defer ticker.Stop()
+	for {
+		err := checkBackend(ctx, config, backend)
+		if ctx.Err() != nil {
+			// stopped while checking
+			return
+		}
+		backend.reportCheck(&config.HealthCheck, err)
+		select {
+		case <-ctx.Done():
+			{
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackend - request health check path from backend, fcgi backends are
+// sent the path as the script to run
+func checkBackend(ctx context.Context, config *Config, backend *Backend) error {
+	if config.HealthCheck.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.HealthCheck.Timeout))
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+config.HealthCheck.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", healthCheckUserAgent)
+	var resp *http.Response
+	switch config.ProxyType {
+	case ProxyTypeHTTP:
+		{
+			resp, err = httpBackendFetch(req, config, backend.Address)
+			break
+		}
+	case ProxyTypeFCGI:
+		{
+			p := GetFCGIEnvVars(req, config)
+			p["SCRIPT_NAME"] = config.HealthCheck.Path
+			p["SCRIPT_FILENAME"] = config.HealthCheck.Path
+			resp, err = getFCGIPool(backend.Address, &config.FCGI).do(req, p)
+			break
+		}
+	default:
+		{
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrNoHost - returned when no virtual host matches the request host
+var ErrNoHost = errors.New("no virtual host matches request host")
+
+// Host - virtual host with the config and extension chain its requests are
+// handled with
+type Host struct {
+	Names      []string
+	Default    bool
+	Config     *Config
+	Extensions []Extension
+	Routes     []*Route
+}
+
+// newHosts - create virtual hosts of config and their routes without
+// extensions, a single default host with the main config when none are
+// configured
+func newHosts(config *Config) []*Host {
+	if len(config.Hosts) == 0 {
+		return []*Host{{Default: true, Config: config, Routes: newRoutes(config)}}
+	}
+	hosts := make([]*Host, 0, len(config.Hosts))
+	for i := range config.Hosts {
+		hostConfig := config.GetHostConfig(&config.Hosts[i])
+		hosts = append(hosts, &Host{
+			Names:   config.Hosts[i].Names,
+			Default: config.Hosts[i].Default,
+			Config:  hostConfig,
+			Routes:  newRoutes(hostConfig),
+		})
+	}
+	return hosts
+}
+
+// key - identifies host across reloads
+func (h *Host) key() string {
+	return strings.ToLower(strings.Join(h.Names, ","))
+}
+
+// extensionChain - extension chain of virtual host or route with the config
+// it is loaded with
+type extensionChain struct {
+	key        string // identifies chain across reloads
+	config     *Config
+	extensions *[]Extension
+}
+
+// getExtensionChains - get extension chains of virtual hosts and of routes
+// that do not use the chain of their host
+func getExtensionChains(hosts []*Host) []extensionChain {
+	chains := make([]extensionChain, 0, len(hosts))
+	for _, host := range hosts {
+		chains = append(chains, extensionChain{key: host.key(), config: host.Config, extensions: &host.Extensions})
+		for i, route := range host.Routes {
+			if route.ownChain {
+				chains = append(chains, extensionChain{
+					key:        host.key() + "/routes[" + strconv.Itoa(i) + "]",
+					config:     route.Config,
+					extensions: &route.Extensions,
+				})
+			}
+		}
+	}
+	return chains
+}
+
+// loadHosts - load extensions of every virtual host and route of config
+func loadHosts(config *Config, subRequestCallback SubRequestCallback) ([]*Host, error) {
+	hosts := newHosts(config)
+	loaded := make([]Extension, 0)
+	for _, chain := range getExtensionChains(hosts) {
+		exts, err := LoadExtensions(chain.config, subRequestCallback)
+		if err != nil {
+			UnloadExtensions(&loaded)
+			return nil, err
+		}
+		loaded = append(loaded, exts...)
+		*chain.extensions = exts
+	}
+	return hosts, nil
+}
+
+// reloadHosts - load extensions of every virtual host and route of new
+// config, chains of hosts and routes in the same place keep their unchanged
+// extensions, returns the extensions of old chains that are no longer used
+func reloadHosts(config *Config, oldHosts []*Host, subRequestCallback SubRequestCallback) ([]*Host, []Extension, error) {
+	hosts := newHosts(config)
+	old := make(map[string]extensionChain)
+	for _, chain := range getExtensionChains(oldHosts) {
+		old[chain.key] = chain
+	}
+	loaded := make([]Extension, 0)
+	removed := make([]Extension, 0)
+	for _, chain := range getExtensionChains(hosts) {
+		oldChain, ok := old[chain.key]
+		if !ok {
+			exts, err := LoadExtensions(chain.config, subRequestCallback)
+			if err != nil {
+				UnloadExtensions(&loaded)
+				return nil, nil, err
+			}
+			loaded = append(loaded, exts...)
+			*chain.extensions = exts
+			continue
+		}
+		delete(old, chain.key)
+		exts, chainRemoved, err := reloadExtensions(chain.config, oldChain.config, *oldChain.extensions, subRequestCallback, &loaded)
+		if err != nil {
+			UnloadExtensions(&loaded)
+			return nil, nil, err
+		}
+		*chain.extensions = exts
+		removed = append(removed, chainRemoved...)
+	}
+	for _, chain := range getExtensionChains(oldHosts) {
+		if _, ok := old[chain.key]; ok {
+			removed = append(removed, *chain.extensions...)
+		}
+	}
+	return hosts, removed, nil
+}
+
+// unloadHosts - unload extensions of virtual hosts and routes
+func unloadHosts(hosts []*Host) {
+	chains := getExtensionChains(hosts)
+	for i := len(chains) - 1; i >= 0; i-- {
+		UnloadExtensions(chains[i].extensions)
+	}
+}
+
+// matchHost - get virtual host for request host, exact names are preferred
+// over wildcards and longer wildcards over shorter ones, the default host
+// is used when no name matches
+func matchHost(hosts []*Host, requestHost string) *Host {
+	name := normalizeHostName(requestHost)
+	var match *Host
+	var defaultHost *Host
+	matchLength := -1
+	for _, host := range hosts {
+		if host.Default && defaultHost == nil {
+			defaultHost = host
+		}
+		for _, pattern := range host.Names {
+			pattern = normalizeHostName(pattern)
+			switch {
+			case pattern == name:
+				{
+					return host
+				}
+			case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(name, pattern[1:]) && len(pattern) > matchLength:
+				{
+					match = host
+					matchLength = len(pattern)
+					break
+				}
+			}
+		}
+	}
+	if match != nil {
+		return match
+	}
+	return defaultHost
+}
+
+// normalizeHostName - lower case host name without port and trailing dot
+func normalizeHostName(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Match - get config and extension chain to handle request with, those of
+// the first matching route of the virtual host or of the host itself, errors
+// with ErrNoHost when virtual hosts are configured and none matches
+func (i *Instance) Match(req *http.Request) (*Config, *[]Extension, error) {
+	host := matchHost(i.Hosts, req.Host)
+	if host == nil {
+		return nil, nil, ErrNoHost
+	}
+	for _, route := range host.Routes {
+		if !route.match(req) {
+			continue
+		}
+		if route.ownChain {
+			return route.Config, &route.Extensions, nil
+		}
+		return route.Config, &host.Extensions, nil
+	}
+	return host.Config, &host.Extensions, nil
+}
@@ -0,0 +1,126 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// httpClients - shared http clients by transport settings
+var httpClients = make(map[HTTPConfig]*http.Client)
+
+// httpClientsMutex - guards http clients
+var httpClientsMutex sync.Mutex
+
+// getHTTPClient - get shared long-lived http client for transport settings
+func getHTTPClient(config *HTTPConfig) (*http.Client, error) {
+	httpClientsMutex.Lock()
+	defer httpClientsMutex.Unlock()
+	if client, ok := httpClients[*config]; ok {
+		return client, nil
+	}
+	transport, err := NewHTTPTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: transport,
+		// redirects are passed on to the client
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	httpClients[*config] = client
+	return client, nil
+}
+
+// pruneHTTPClients - close idle connections of and remove shared http
+// clients none of the configs use
+func pruneHTTPClients(configs []*Config) {
+	used := make(map[HTTPConfig]bool)
+	for _, config := range configs {
+		used[config.HTTP] = true
+	}
+	httpClientsMutex.Lock()
+	defer httpClientsMutex.Unlock()
+	for httpConfig, client := range httpClients {
+		if !used[httpConfig] {
+			client.CloseIdleConnections()
+			delete(httpClients, httpConfig)
+		}
+	}
+}
+
+// NewHTTPTransport - create http transport from config
+func NewHTTPTransport(config *HTTPConfig) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.DialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(config.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(config.ResponseHeaderTimeout),
+		IdleConnTimeout:       time.Duration(config.IdleConnTimeout),
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     config.HTTP2,
+	}, nil
+}
+
+// newTLSConfig - create tls config with custom ca bundle and client certificate
+func newTLSConfig(config *HTTPConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		caBytes, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in ca file '%s'", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,292 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogFormatText - denotes human readable log output
+const LogFormatText = "text"
+
+// LogFormatLogfmt - denotes logfmt log output
+const LogFormatLogfmt = "logfmt"
+
+// LogFormatJSON - denotes json log output, one object per line
+const LogFormatJSON = "json"
+
+// LogLevel - log message severity
+type LogLevel int
+
+// log levels
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// logLevelNames - log level names as configured and written
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+// String - get level name
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// ParseLogLevel - get log level by name
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// logOutput - destination shared by a logger and the loggers derived from it
+type logOutput struct {
+	writer io.Writer
+	file   *os.File // opened by NewLogger, closed by Close
+	level  LogLevel
+	format string
+	mutex  sync.Mutex
+}
+
+// Logger - leveled logger writing messages with key value fields
+type Logger struct {
+	output *logOutput
+	fields []interface{}
+}
+
+// defaultLogger - logger used by the proxy and extensions
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(&Logger{output: &logOutput{writer: os.Stderr, level: LogLevelInfo, format: LogFormatText}})
+}
+
+// NewLogger - create logger from config
+func NewLogger(config *LogConfig) (*Logger, error) {
+	level, err := ParseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Format {
+	case LogFormatText, LogFormatLogfmt, LogFormatJSON:
+		break
+	default:
+		{
+			return nil, fmt.Errorf("unknown log format '%s'", config.Format)
+		}
+	}
+	switch config.Output {
+	case "", "stderr":
+		{
+			return NewLoggerWithWriter(os.Stderr, level, config.Format), nil
+		}
+	case "stdout":
+		{
+			return NewLoggerWithWriter(os.Stdout, level, config.Format), nil
+		}
+	}
+	file, err := os.OpenFile(config.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger := NewLoggerWithWriter(file, level, config.Format)
+	logger.output.file = file
+	return logger, nil
+}
+
+// NewLoggerWithWriter - create logger writing to given writer
+func NewLoggerWithWriter(writer io.Writer, level LogLevel, format string) *Logger {
+	return &Logger{output: &logOutput{writer: writer, level: level, format: format}}
+}
+
+// Close - close log file opened by NewLogger, loggers writing to stderr,
+// stdout or a given writer are left open
+func (l *Logger) Close() error {
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+	if l.output.file == nil {
+		return nil
+	}
+	err := l.output.file.Close()
+	l.output.file = nil
+	return err
+}
+
+// GetLogger - get logger used by the proxy, extensions should log through it
+// so their output matches
+func GetLogger() *Logger {
+	return defaultLogger.Load().(*Logger)
+}
+
+// SetLogger - replace logger used by the proxy
+func SetLogger(logger *Logger) {
+	defaultLogger.Store(logger)
+}
+
+// RequestLogger - get logger with the request id field set
+func RequestLogger(req *http.Request) *Logger {
+	if rc := GetRequestContext(req); rc != nil {
+		return GetLogger().With("request_id", rc.ID)
+	}
+	return GetLogger()
+}
+
+// With - get logger that adds key value fields to every message
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{output: l.output, fields: fields}
+}
+
+// Enabled - determine if messages of given level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.output.level
+}
+
+// Debug - write debug message with key value fields
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.write(LogLevelDebug, msg, keyvals)
+}
+
+// Info - write info message with key value fields
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.write(LogLevelInfo, msg, keyvals)
+}
+
+// Warn - write warning message with key value fields
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.write(LogLevelWarn, msg, keyvals)
+}
+
+// Error - write error message with key value fields
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.write(LogLevelError, msg, keyvals)
+}
+
+// write - format and write message
+func (l *Logger) write(level LogLevel, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, nil)
+	}
+	buf := bytes.Buffer{}
+	switch l.output.format {
+	case LogFormatJSON:
+		{
+			buf.WriteString(`{"time":`)
+			writeLogJSON(&buf, now.Format(time.RFC3339Nano))
+			buf.WriteString(`,"level":`)
+			writeLogJSON(&buf, level.String())
+			buf.WriteString(`,"msg":`)
+			writeLogJSON(&buf, msg)
+			for i := 0; i < len(fields); i += 2 {
+				buf.WriteByte(',')
+				writeLogJSON(&buf, fmt.Sprint(fields[i]))
+				buf.WriteByte(':')
+				writeLogJSON(&buf, logValue(fields[i+1]))
+			}
+			buf.WriteString("}\n")
+			break
+		}
+	case LogFormatLogfmt:
+		{
+			buf.WriteString("time=" + now.Format(time.RFC3339Nano) + " level=" + level.String() + " msg=" + logfmtValue(msg))
+			writeLogfmtFields(&buf, fields)
+			buf.WriteByte('\n')
+			break
+		}
+	default:
+		{
+			buf.WriteString(now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(level.String()) + " " + msg)
+			writeLogfmtFields(&buf, fields)
+			buf.WriteByte('\n')
+			break
+		}
+	}
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+	l.output.writer.Write(buf.Bytes())
+}
+
+// logValue - convert field value for output
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		{
+			return v.Error()
+		}
+	case time.Duration:
+		{
+			return v.String()
+		}
+	case fmt.Stringer:
+		{
+			return v.String()
+		}
+	}
+	return value
+}
+
+// writeLogJSON - write value as json, falls back to its string form
+func writeLogJSON(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+// writeLogfmtFields - write key value fields in logfmt
+func writeLogfmtFields(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(fmt.Sprint(logValue(fields[i+1]))))
+	}
+}
+
+// logfmtValue - quote value when needed
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\r\n\\") {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -0,0 +1,303 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsContentType - content type of the prometheus text format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricDurationBuckets - histogram buckets for durations in seconds
+var metricDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricMethods - request methods reported as is, others are reported as OTHER
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// metric - counter or histogram with labels
+type metric struct {
+	name    string
+	help    string
+	kind    string // counter, histogram
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*metricSeries
+}
+
+// metricSeries - values for one set of label values
+type metricSeries struct {
+	labelValues []string
+	value       float64 // counter value or histogram sum
+	count       uint64
+	buckets     []uint64
+}
+
+// MetricValue - counter value for one set of label values
+type MetricValue struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// metrics - all registered counters and histograms in output order
+var metrics = make([]*metric, 0)
+
+// inFlightRequests - number of requests being handled
+var inFlightRequests int64
+
+var (
+	requestsTotal = newCounter(
+		"cproxy_requests_total", "Requests handled by method and status code.",
+		"method", "status",
+	)
+	requestDuration = newHistogram(
+		"cproxy_request_duration_seconds", "Time taken to handle requests.",
+	)
+	backendDuration = newHistogram(
+		"cproxy_backend_request_duration_seconds", "Time taken by backend fetches.",
+		"backend",
+	)
+	backendErrorsTotal = newCounter(
+		"cproxy_backend_errors_total", "Backend fetches that failed.",
+		"backend",
+	)
+	extensionDuration = newHistogram(
+		"cproxy_extension_duration_seconds", "Time taken by extension events.",
+		"extension", "event",
+	)
+	extensionShortCircuitsTotal = newCounter(
+		"cproxy_extension_short_circuits_total", "Requests answered by an extension OnRequest, cache hits included.",
+		"extension",
+	)
+)
+
+// newCounter - create and register counter
+func newCounter(name string, help string, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*metricSeries)}
+	metrics = append(metrics, m)
+	return m
+}
+
+// newHistogram - create and register histogram with duration buckets
+func newHistogram(name string, help string, labels ...string) *metric {
+	m := newCounter(name, help, labels...)
+	m.kind = "histogram"
+	m.buckets = metricDurationBuckets
+	return m
+}
+
+// getSeries - get series for label values, caller holds mutex
+func (m *metric) getSeries(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\x00")
+	series, ok := m.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues, buckets: make([]uint64, len(m.buckets))}
+		m.series[key] = series
+	}
+	return series
+}
+
+// add - add to counter
+func (m *metric) add(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.getSeries(labelValues).value += value
+}
+
+// observe - add observation to histogram
+func (m *metric) observe(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	series := m.getSeries(labelValues)
+	series.value += value
+	series.count++
+	for i, bound := range m.buckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+}
+
+// write - write metric in prometheus text format
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := m.series[key]
+		labels := formatMetricLabels(m.labels, series.labelValues)
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, wrapMetricLabels(labels), formatMetricValue(series.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapMetricLabels(labels, `le="`+formatMetricValue(bound)+`"`), series.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapMetricLabels(labels, `le="+Inf"`), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, wrapMetricLabels(labels), formatMetricValue(series.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, wrapMetricLabels(labels), series.count)
+	}
+}
+
+// RequestStarted - record request has started, call RequestFinished when done
+func RequestStarted() {
+	atomic.AddInt64(&inFlightRequests, 1)
+}
+
+// RequestFinished - record request has completed with status code
+func RequestFinished(req *http.Request, statusCode int, duration time.Duration) {
+	atomic.AddInt64(&inFlightRequests, -1)
+	method := req.Method
+	if !metricMethods[method] {
+		method = "OTHER"
+	}
+	requestsTotal.add(1, method, strconv.Itoa(statusCode))
+	requestDuration.observe(duration.Seconds())
+}
+
+// InFlightRequests - number of requests currently being handled
+func InFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
+
+// GetCounters - get current counter values by metric name
+func GetCounters() map[string][]MetricValue {
+	counters := make(map[string][]MetricValue)
+	for _, m := range metrics {
+		if m.kind != "counter" {
+			continue
+		}
+		counters[m.name] = m.values()
+	}
+	return counters
+}
+
+// values - get counter values sorted by label values
+func (m *metric) values() []MetricValue {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]MetricValue, 0, len(keys))
+	for _, key := range keys {
+		series := m.series[key]
+		labels := make(map[string]string, len(m.labels))
+		for i, name := range m.labels {
+			labels[name] = series.labelValues[i]
+		}
+		values = append(values, MetricValue{Labels: labels, Value: series.value})
+	}
+	return values
+}
+
+// WriteMetrics - write all metrics in prometheus text format
+func WriteMetrics(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	// gauges read at scrape time
+	writeMetricGauge(bw, "cproxy_requests_in_flight", "Requests currently being handled.", map[string]float64{"": float64(InFlightRequests())})
+	activeRequests := make(map[string]float64)
+	healthy := make(map[string]float64)
+	for _, backendHealth := range GetBackendHealth() {
+		activeRequests[backendHealth.Address] = float64(backendHealth.ActiveConns)
+		healthy[backendHealth.Address] = 0
+		if backendHealth.Healthy {
+			healthy[backendHealth.Address] = 1
+		}
+	}
+	writeMetricGauge(bw, "cproxy_backend_active_requests", "Requests currently sent to backend.", activeRequests)
+	writeMetricGauge(bw, "cproxy_backend_healthy", "Backend is in rotation (1) or ejected (0).", healthy)
+	openConns := make(map[string]float64)
+	idleConns := make(map[string]float64)
+	for _, stats := range GetFCGIPoolStats() {
+		openConns[stats.Address] += float64(stats.Open)
+		idleConns[stats.Address] += float64(stats.Idle)
+	}
+	writeMetricGauge(bw, "cproxy_fcgi_pool_open_connections", "Open FastCGI connections.", openConns)
+	writeMetricGauge(bw, "cproxy_fcgi_pool_idle_connections", "Idle FastCGI connections.", idleConns)
+}
+
+// writeMetricGauge - write gauge with a value per backend, empty backend
+// is written without labels
+func writeMetricGauge(w io.Writer, name string, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	backends := make([]string, 0, len(values))
+	for backend := range values {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	for _, backend := range backends {
+		labels := []string{}
+		if backend != "" {
+			labels = formatMetricLabels([]string{"backend"}, []string{backend})
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, wrapMetricLabels(labels), formatMetricValue(values[backend]))
+	}
+}
+
+// formatMetricLabels - format label pairs with escaped values
+func formatMetricLabels(names []string, values []string) []string {
+	labels := make([]string, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		labels = append(labels, name+`="`+value+`"`)
+	}
+	return labels
+}
+
+// wrapMetricLabels - join labels in braces, empty when there are none
+func wrapMetricLabels(labels []string, extra ...string) string {
+	labels = append(append([]string{}, labels...), extra...)
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// formatMetricValue - format float in prometheus text format
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,136 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDHeader - header carrying the request id
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDMaxLength - longest incoming request id that is accepted
+const requestIDMaxLength = 128
+
+// requestCount - request counter
+var requestCount uint64
+
+// requestContextKey - key for request context in context.Context
+type requestContextKey struct{}
+
+// RequestContext - per request data shared by the handler, extensions,
+// sub requests and logging
+type RequestContext struct {
+	ID       string
+	Number   uint64
+	Start    time.Time
+	Parent   *RequestContext // set for sub requests
+	Instance *Instance       // instance the request is handled with, inherited by sub requests
+	mutex    sync.RWMutex
+	values   map[string]interface{}
+}
+
+// NewRequestContext - create request context and attach it to a copy of the
+// request, request id is sent upstream in the X-Request-ID header
+func NewRequestContext(req *http.Request) (*http.Request, *RequestContext) {
+	rc := &RequestContext{
+		Number: atomic.AddUint64(&requestCount, 1),
+		Start:  time.Now(),
+		Parent: GetRequestContext(req),
+		values: make(map[string]interface{}),
+	}
+	if rc.Parent != nil {
+		rc.Instance = rc.Parent.Instance
+	}
+	// keep id assigned by a proxy in front of us, sub requests always get their own
+	rc.ID = req.Header.Get(RequestIDHeader)
+	if rc.Parent != nil || !isValidRequestID(rc.ID) {
+		rc.ID = newRequestID(rc.Number)
+	}
+	req.Header.Set(RequestIDHeader, rc.ID)
+	return req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc)), rc
+}
+
+// GetRequestContext - get request context attached to request, nil if none
+func GetRequestContext(req *http.Request) *RequestContext {
+	if req == nil {
+		return nil
+	}
+	rc, _ := req.Context().Value(requestContextKey{}).(*RequestContext)
+	return rc
+}
+
+// Set - set value on request context
+func (rc *RequestContext) Set(key string, value interface{}) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.values[key] = value
+}
+
+// Get - get value from request context
+func (rc *RequestContext) Get(key string) (interface{}, bool) {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	value, ok := rc.values[key]
+	return value, ok
+}
+
+// Delete - remove value from request context
+func (rc *RequestContext) Delete(key string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	delete(rc.values, key)
+}
+
+// Duration - time since request started
+func (rc *RequestContext) Duration() time.Duration {
+	return time.Since(rc.Start)
+}
+
+// newRequestID - generate random request id, falls back to request number
+func newRequestID(number uint64) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatUint(number, 10)
+	}
+	// uuid version 4
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// isValidRequestID - check incoming request id is safe to reuse
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,87 +1,178 @@
-/*
-This file is part of CProxy.
-
-CProxy is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-CProxy is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package cproxy
-
-import (
-	"fmt"
-	"log"
-	"net/http"
-)
-
-// requestCount - request counter
-var requestCount = 0
-
-// HandleRequest - handle a request
-func HandleRequest(req *http.Request, config *Config, exts *[]Extension) (*http.Response, error) {
-
-	// increment request count
-	requestCount++
-	requestNumber := requestCount
-
-	// output to log
-	log.Println("REQUEST", requestNumber, "::", req.Method, req.URL.String())
-
-	// call 'OnRequest'
-	var resp *http.Response
-	if exts != nil {
-		for _, ext := range *exts {
-			log.Println("REQUEST", requestNumber, ":: EVENT :: OnRequest ::", ext.Name)
-			var err error
-			resp, err = ext.OnRequest(req)
-			if err != nil {
-				return nil, err
-			}
-			if resp != nil {
-				// if response returned then assume it is a cached
-				// response and no further manipulation is needed
-				log.Println("REQUEST", requestNumber, ":: Completed")
-				return resp, nil
-			}
-		}
-	}
-
-	// backend fetch, only if response is nil
-	if resp == nil {
-		log.Println("REQUEST", requestNumber, ":: Backend fetch")
-		var err error
-		resp, err = BackendFetch(req, config)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	// call 'OnResponse'
-	if exts != nil {
-		for _, ext := range *exts {
-			log.Println("REQUEST", requestNumber, ":: EVENT :: OnResponse ::", ext.Name)
-			var err error
-			resp, err = ext.OnResponse(resp)
-			if err != nil {
-				return nil, err
-			}
-			if resp == nil {
-				return nil, fmt.Errorf("extension %s OnResponse returned nil response", ext.Name)
-			}
-			resp.Request = req
-		}
-	}
-
-	log.Println("REQUEST", requestNumber, ":: Completed")
-	return resp, nil
-
-}
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HandleRequest - handle a request
+func HandleRequest(req *http.Request, config *Config, exts *[]Extension) (*http.Response, error) {
+
+	// get request context, create one if caller has not
+	rc := GetRequestContext(req)
+	if rc == nil {
+		req, rc = NewRequestContext(req)
+	}
+	logger := RequestLogger(req)
+
+	// output to log
+	logger.Info("request", "method", req.Method, "url", req.URL.String())
+
+	// call 'OnRequest'
+	var resp *http.Response
+	if exts != nil {
+		for _, ext := range *exts {
+			logger.Debug("extension event", "extension", ext.Name, "event", "OnRequest")
+			var err error
+			span := startExtensionSpan(req, ext, "OnRequest")
+			start := time.Now()
+			resp, err = callOnRequest(ext, req)
+			extensionDuration.observe(time.Since(start).Seconds(), ext.Name, "OnRequest")
+			span.SetError(err)
+			span.End()
+			if err != nil {
+				return nil, err
+			}
+			if resp != nil {
+				extensionShortCircuitsTotal.add(1, ext.Name)
+				rc.Set(RequestContextHandledBy, ext.Name)
+				// if response returned then assume it is a cached
+				// response and no further manipulation is needed
+				logger.Info("request completed", "extension", ext.Name, "duration", rc.Duration())
+				return resp, nil
+			}
+		}
+	}
+
+	// backend fetch, only if response is nil
+	if resp == nil {
+		logger.Debug("backend fetch")
+		var err error
+		resp, err = coalesceFetch(req, config)
+		if err != nil {
+			// extensions may replace failed fetch, i.e. with a stale cached response
+			if exts != nil {
+				for _, ext := range *exts {
+					if ext.OnError == nil {
+						continue
+					}
+					logger.Debug("extension event", "extension", ext.Name, "event", "OnError")
+					span := startExtensionSpan(req, ext, "OnError")
+					start := time.Now()
+					errResp, extErr := callOnError(ext, req, err)
+					extensionDuration.observe(time.Since(start).Seconds(), ext.Name, "OnError")
+					span.SetError(extErr)
+					span.End()
+					if extErr != nil {
+						return nil, extErr
+					}
+					if errResp != nil {
+						rc.Set(RequestContextHandledBy, ext.Name)
+						logger.Info("request completed", "extension", ext.Name, "duration", rc.Duration())
+						return errResp, nil
+					}
+				}
+			}
+			return nil, err
+		}
+		resp.Request = req
+	}
+
+	// call 'OnResponse'
+	if exts != nil {
+		// response is already in memory unless in stream mode
+		buffered := !config.StreamResponse
+		for _, ext := range *exts {
+			if ext.BufferResponse && !buffered {
+				logger.Debug("buffer response", "extension", ext.Name)
+				var err error
+				resp, err = BufferResponse(resp, req)
+				if err != nil {
+					return nil, &BackendError{Err: err}
+				}
+				buffered = true
+			}
+			logger.Debug("extension event", "extension", ext.Name, "event", "OnResponse")
+			var err error
+			span := startExtensionSpan(req, ext, "OnResponse")
+			start := time.Now()
+			resp, err = callOnResponse(ext, resp)
+			extensionDuration.observe(time.Since(start).Seconds(), ext.Name, "OnResponse")
+			span.SetError(err)
+			span.End()
+			if err != nil {
+				return nil, err
+			}
+			if resp == nil {
+				return nil, &ExtensionError{
+					Extension: ext.Name,
+					Event:     "OnResponse",
+					Err:       errors.New("returned nil response"),
+				}
+			}
+			resp.Request = req
+		}
+	}
+
+	logger.Info("request completed", "status", resp.StatusCode, "duration", rc.Duration())
+	return resp, nil
+
+}
+
+// callOnRequest - call extension OnRequest, panics are returned as errors
+func callOnRequest(ext Extension, req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic, %v", r)
+		}
+		if err != nil {
+			resp, err = nil, &ExtensionError{Extension: ext.Name, Event: "OnRequest", Err: err}
+		}
+	}()
+	return ext.OnRequest(req)
+}
+
+// callOnResponse - call extension OnResponse, panics are returned as errors
+func callOnResponse(ext Extension, resp *http.Response) (newResp *http.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic, %v", r)
+		}
+		if err != nil {
+			newResp, err = nil, &ExtensionError{Extension: ext.Name, Event: "OnResponse", Err: err}
+		}
+	}()
+	return ext.OnResponse(resp)
+}
+
+// callOnError - call extension OnError, panics are returned as errors
+func callOnError(ext Extension, req *http.Request, fetchErr error) (resp *http.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic, %v", r)
+		}
+		if err != nil {
+			resp, err = nil, &ExtensionError{Extension: ext.Name, Event: "OnError", Err: err}
+		}
+	}()
+	return ext.OnError(req, fetchErr)
+}
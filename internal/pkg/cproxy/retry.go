@@ -0,0 +1,111 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isRetryableMethod - determine if requests with method may be retried
+func isRetryableMethod(config *RetryConfig, method string) bool {
+	for _, retryMethod := range config.Methods {
+		if strings.EqualFold(retryMethod, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRetry - determine if fetch result should be retried, requests
+// cancelled by the client are never retried
+func shouldRetry(config *RetryConfig, req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	for _, statusCode := range config.StatusCodes {
+		if resp.StatusCode == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryBackoff - time to wait before given retry, doubled every attempt
+// with random jitter of up to half the delay
+func retryBackoff(config *RetryConfig, retry int) time.Duration {
+	delay := time.Duration(config.Backoff)
+	for i := 1; i < retry && (config.MaxBackoff <= 0 || delay < time.Duration(config.MaxBackoff)); i++ {
+		delay *= 2
+	}
+	if config.MaxBackoff > 0 && delay > time.Duration(config.MaxBackoff) {
+		delay = time.Duration(config.MaxBackoff)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// bufferRequestBody - read request body so it can be sent again, returns
+// false when the body is larger than max size, the body is left readable
+// in full either way
+func bufferRequestBody(req *http.Request, maxSize int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(bodyBytes)) > maxSize {
+		req.Body = &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(bodyBytes), req.Body),
+			Closer: req.Body,
+		}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return bodyBytes, true, nil
+}
+
+// replayRequestBody - reset request body to buffered bytes
+func replayRequestBody(req *http.Request, bodyBytes []byte) {
+	if bodyBytes == nil {
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(bodyBytes)), nil
+	}
+	req.ContentLength = int64(len(bodyBytes))
+}
+
+// readCloser - reader with a separate closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
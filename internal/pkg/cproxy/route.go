@@ -0,0 +1,112 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Route - route of virtual host with the config and extension chain its
+// requests are handled with
+type Route struct {
+	Config     *Config
+	Extensions []Extension // empty when route uses the chain of its host
+	ownChain   bool
+	prefix     string
+	regex      *regexp.Regexp
+	methods    []string
+	headers    map[string]*regexp.Regexp
+}
+
+// newRoutes - create routes of virtual host or main config without
+// extensions, config must have been validated
+func newRoutes(config *Config) []*Route {
+	routes := make([]*Route, 0, len(config.Routes))
+	for i := range config.Routes {
+		routeConfig := &config.Routes[i]
+		route := &Route{
+			Config:   config.GetRouteConfig(routeConfig),
+			ownChain: routeConfig.Extensions.Path != "" || routeConfig.Extensions.Enabled != nil || len(routeConfig.Extensions.Config) > 0,
+			prefix:   routeConfig.Prefix,
+			methods:  routeConfig.Methods,
+			headers:  make(map[string]*regexp.Regexp),
+		}
+		if routeConfig.Regex != "" {
+			route.regex = regexp.MustCompile(routeConfig.Regex)
+		}
+		for name, pattern := range routeConfig.Headers {
+			route.headers[textproto.CanonicalMIMEHeaderKey(name)] = regexp.MustCompile(pattern)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// match - determine if request matches every condition of route
+func (r *Route) match(req *http.Request) bool {
+	// match the path the backend will resolve, /public/../admin is /admin
+	reqPath := cleanPath(req.URL.Path)
+	if r.prefix != "" && !isPathPrefix(reqPath, r.prefix) {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(reqPath) {
+		return false
+	}
+	if len(r.methods) > 0 {
+		methodMatch := false
+		for _, method := range r.methods {
+			if strings.EqualFold(method, req.Method) {
+				methodMatch = true
+				break
+			}
+		}
+		if !methodMatch {
+			return false
+		}
+	}
+	for name, pattern := range r.headers {
+		values, ok := req.Header[name]
+		if !ok || !pattern.MatchString(strings.Join(values, ",")) {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanPath - resolve dot segments and duplicate slashes in request path,
+// keeps trailing slash
+func cleanPath(reqPath string) string {
+	cleaned := path.Clean("/" + reqPath)
+	if strings.HasSuffix(reqPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// isPathPrefix - determine if path is prefix or below it, /api matches
+// /api and /api/users but not /apis
+func isPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
@@ -0,0 +1,274 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Instance - config and extension chain requests are handled with, a reload
+// replaces the instance as a whole
+type Instance struct {
+	Config     *Config
+	Extensions []Extension // main chain, empty when virtual hosts are configured
+	Hosts      []*Host     // virtual hosts, a single default host with the main chain when none are configured
+	AccessLog  *AccessLog  // nil when disabled
+	mutex      sync.Mutex
+	active     int  // requests being handled with instance
+	retired    bool // replaced by reload
+	drained    chan struct{}
+}
+
+// Runtime - holds the instance new requests are handled with
+type Runtime struct {
+	current          atomic.Value // *Instance
+	mutex            sync.Mutex   // serializes reloads
+	loadConfig       func() (Config, error)
+	stopHealthChecks func()
+	draining         map[*Instance][]Extension // replaced instances with requests in-flight and the extensions removed with them
+}
+
+// NewRuntime - validate config, load extensions and start health checks,
+// load config is called on reload to get the new config
+func NewRuntime(config Config, loadConfig func() (Config, error)) (*Runtime, error) {
+	if err := ValidateConfig(&config); err != nil {
+		return nil, err
+	}
+	r := &Runtime{loadConfig: loadConfig, draining: make(map[*Instance][]Extension)}
+	hosts, err := loadHosts(&config, r.SubRequest)
+	if err != nil {
+		return nil, err
+	}
+	accessLog, err := NewAccessLog(&config.AccessLog)
+	if err != nil {
+		unloadHosts(hosts)
+		return nil, err
+	}
+	r.current.Store(newInstance(&config, hosts, accessLog))
+	r.stopHealthChecks = StartHealthChecks(&config)
+	return r, nil
+}
+
+// newInstance - create instance
+func newInstance(config *Config, hosts []*Host, accessLog *AccessLog) *Instance {
+	instance := &Instance{
+		Config:    config,
+		Hosts:     hosts,
+		AccessLog: accessLog,
+		drained:   make(chan struct{}),
+	}
+	if len(config.Hosts) == 0 {
+		instance.Extensions = hosts[0].Extensions
+	}
+	return instance
+}
+
+// Current - get instance new requests are handled with
+func (r *Runtime) Current() *Instance {
+	return r.current.Load().(*Instance)
+}
+
+// Acquire - get instance to handle request with, call Release on it once
+// the response has been written
+func (r *Runtime) Acquire() *Instance {
+	for {
+		instance := r.Current()
+		if instance.acquire() {
+			return instance
+		}
+		// replaced between load and acquire
+	}
+}
+
+// SubRequest - handle sub request made by an extension with the instance of
+// its parent request, or the current instance when it has none or the parent
+// instance has drained since
+func (r *Runtime) SubRequest(req *http.Request) (*http.Response, error) {
+	req, rc := NewRequestContext(req)
+	req.Header.Set("X-Sub-Request", "1")
+	instance := rc.Instance
+	if instance == nil || !instance.join() {
+		instance = r.Acquire()
+	}
+	defer instance.Release()
+	rc.Instance = instance
+	config, exts, err := instance.Match(req)
+	if err != nil {
+		return nil, err
+	}
+	return HandleRequest(req, config, exts)
+}
+
+// Reload - load and validate new config then swap it in with its extension
+// chain, in-flight requests finish on the old chain and extensions that are
+// no longer used are unloaded after, the old instance is kept on error
+func (r *Runtime) Reload() error {
+	if r.loadConfig == nil {
+		return errors.New("reload not supported")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	config, err := r.loadConfig()
+	if err != nil {
+		return err
+	}
+	old := r.Current()
+	// listeners are not re-created
+	if config.ProxyType != old.Config.ProxyType || config.Listen != old.Config.Listen || config.Admin.Listen != old.Config.Admin.Listen {
+		GetLogger().Warn("listener config changed, restart to apply")
+		config.ProxyType = old.Config.ProxyType
+		config.Listen = old.Config.Listen
+		config.Admin.Listen = old.Config.Admin.Listen
+	}
+	if err := ValidateConfig(&config); err != nil {
+		return err
+	}
+	// log file is only reopened when log config changed
+	oldLogger := GetLogger()
+	logger := oldLogger
+	if config.Log != old.Config.Log {
+		if logger, err = NewLogger(&config.Log); err != nil {
+			return err
+		}
+	}
+	// access log is only reopened when its config changed
+	accessLog := old.AccessLog
+	if config.AccessLog != old.Config.AccessLog {
+		if accessLog, err = NewAccessLog(&config.AccessLog); err != nil {
+			if logger != oldLogger {
+				logger.Close()
+			}
+			return err
+		}
+	}
+	hosts, removed, err := reloadHosts(&config, old.Hosts, r.SubRequest)
+	if err != nil {
+		if logger != oldLogger {
+			logger.Close()
+		}
+		if accessLog != old.AccessLog && accessLog != nil {
+			accessLog.Close()
+		}
+		return err
+	}
+	SetLogger(logger)
+	r.stopHealthChecks()
+	r.stopHealthChecks = StartHealthChecks(&config)
+	r.current.Store(newInstance(&config, hosts, accessLog))
+	r.draining[old] = removed
+	drained := old.retire()
+	go func() {
+		<-drained
+		r.finishDrain(old)
+		if logger != oldLogger {
+			oldLogger.Close()
+		}
+		if accessLog != old.AccessLog && old.AccessLog != nil {
+			old.AccessLog.Close()
+		}
+	}()
+	GetLogger().Info("config reloaded", "hosts", len(config.Hosts), "removed", len(removed))
+	return nil
+}
+
+// finishDrain - unload extensions removed with drained instance then remove
+// balancers, clients and connection pools no instance in use is configured
+// with, nothing is left to do when the runtime was closed first
+func (r *Runtime) finishDrain(drained *Instance) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	removed, ok := r.draining[drained]
+	if !ok {
+		return
+	}
+	delete(r.draining, drained)
+	UnloadExtensions(&removed)
+	configs := r.Current().Config.getSiteConfigs()
+	for instance := range r.draining {
+		configs = append(configs, instance.Config.getSiteConfigs()...)
+	}
+	pruneBalancers(configs)
+	pruneHTTPClients(configs)
+	pruneFCGIPools(configs)
+}
+
+// Close - stop health checks, close the access log, unload extensions of
+// current instance and extensions removed by a reload whose old instance has
+// not drained yet
+func (r *Runtime) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopHealthChecks()
+	r.stopHealthChecks = func() {}
+	if accessLog := r.Current().AccessLog; accessLog != nil {
+		accessLog.Close()
+	}
+	unloadHosts(r.Current().Hosts)
+	for instance, removed := range r.draining {
+		delete(r.draining, instance)
+		UnloadExtensions(&removed)
+	}
+}
+
+// acquire - count request against instance, false when instance was retired
+func (i *Instance) acquire() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.retired {
+		return false
+	}
+	i.active++
+	return true
+}
+
+// join - count sub request against instance, false when instance was retired
+// and its last request is done
+func (i *Instance) join() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.retired && i.active == 0 {
+		return false
+	}
+	i.active++
+	return true
+}
+
+// Release - mark request handled with instance as done
+func (i *Instance) Release() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.active--
+	if i.retired && i.active == 0 {
+		close(i.drained)
+	}
+}
+
+// retire - mark instance replaced, returned channel is closed once its last
+// request is done
+func (i *Instance) retire() <-chan struct{} {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.retired = true
+	if i.active == 0 {
+		close(i.drained)
+	}
+	return i.drained
+}
@@ -0,0 +1,163 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownIdleAfter - connections without traffic for this long are closed
+// on shutdown once no request is in-flight
+const shutdownIdleAfter = time.Second
+
+// shutdownPollInterval - interval in-flight requests are checked at while
+// draining
+const shutdownPollInterval = 50 * time.Millisecond
+
+// TrackedListener - listener that keeps track of its open connections, a
+// connection that was accepted before shutdown counts until it has been idle
+// so requests whose handler has not started yet are not cut off
+type TrackedListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns map[*trackedConn]bool
+}
+
+// trackedConn - connection accepted by tracked listener
+type trackedConn struct {
+	net.Conn
+	listener   *TrackedListener
+	lastActive int64 // unix nano of last read or write
+	closeOnce  sync.Once
+}
+
+// TrackListener - wrap listener to track its connections
+func TrackListener(listener net.Listener) *TrackedListener {
+	return &TrackedListener{Listener: listener, conns: make(map[*trackedConn]bool)}
+}
+
+// Accept - accept connection and track it until closed
+func (l *TrackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, listener: l}
+	tc.touch()
+	l.mutex.Lock()
+	l.conns[tc] = true
+	l.mutex.Unlock()
+	return tc, nil
+}
+
+// OpenConnections - number of accepted connections that are not closed
+func (l *TrackedListener) OpenConnections() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.conns)
+}
+
+// closeIdle - close connections without traffic for given duration, returns
+// number of connections still open
+func (l *TrackedListener) closeIdle(idle time.Duration) int {
+	l.mutex.Lock()
+	conns := make([]*trackedConn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mutex.Unlock()
+	open := 0
+	for _, conn := range conns {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastActive))) < idle {
+			open++
+			continue
+		}
+		conn.Close()
+	}
+	return open
+}
+
+// touch - record traffic on connection
+func (c *trackedConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// Read - read and record traffic
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// Write - write and record traffic
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// Close - close connection and stop tracking it
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.listener.mutex.Lock()
+		delete(c.listener.conns, c)
+		c.listener.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// Shutdown - stop accepting connections and wait until no request is
+// in-flight and every connection of listener is closed or idle, the http
+// server is shut down gracefully when given, returns the context error when
+// requests are still in-flight once it is done
+func Shutdown(ctx context.Context, server *http.Server, listener *TrackedListener) error {
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			GetLogger().Warn("shutdown", "error", err)
+		}
+	}
+	if err := CloseListener(listener); err != nil {
+		GetLogger().Warn("shutdown", "error", err)
+	}
+	// fastcgi connections are not drained by closing the listener
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		// connections are only closed once idle, a request that was
+		// accepted may not have reached its handler yet
+		if InFlightRequests() == 0 && listener.closeIdle(shutdownIdleAfter) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			{
+				return ctx.Err()
+			}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// staticFetch - serve file below static root for request path, directories
+// are served their index file and are never listed
+func staticFetch(req *http.Request, config *Config) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := staticStatusResponse(req, http.StatusMethodNotAllowed)
+		resp.Header.Set("Allow", http.MethodGet+", "+http.MethodHead)
+		return resp, nil
+	}
+	filePath := filepath.Join(config.Static.Root, filepath.FromSlash(path.Clean("/"+req.URL.Path)))
+	file, info, err := openStaticFile(filePath)
+	if err == nil && info.IsDir() {
+		file.Close()
+		if config.Static.Index == "" {
+			return staticStatusResponse(req, http.StatusNotFound), nil
+		}
+		file, info, err = openStaticFile(filepath.Join(filePath, config.Static.Index))
+		if err == nil && info.IsDir() {
+			file.Close()
+			return staticStatusResponse(req, http.StatusNotFound), nil
+		}
+	}
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, os.ErrNotExist):
+		{
+			return staticStatusResponse(req, http.StatusNotFound), nil
+		}
+	case errors.Is(err, os.ErrPermission):
+		{
+			return staticStatusResponse(req, http.StatusForbidden), nil
+		}
+	default:
+		{
+			return nil, err
+		}
+	}
+	resp := staticStatusResponse(req, http.StatusOK)
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	resp.Header.Set("Last-Modified", modTime.Format(http.TimeFormat))
+	if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modTime.After(since) {
+		file.Close()
+		resp = staticStatusResponse(req, http.StatusNotModified)
+		resp.Header.Set("Last-Modified", modTime.Format(http.TimeFormat))
+		return resp, nil
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(info.Name()))
+	if contentType == "" {
+		// sniff content and rewind
+		sniff := make([]byte, 512)
+		n, _ := io.ReadFull(file, sniff)
+		contentType = http.DetectContentType(sniff[:n])
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	resp.ContentLength = info.Size()
+	if req.Method == http.MethodHead {
+		file.Close()
+		return resp, nil
+	}
+	resp.Body = file
+	return resp, nil
+}
+
+// openStaticFile - open file and get its info
+func openStaticFile(filePath string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+// staticStatusResponse - response with status text as body, empty for ok
+// and not modified
+func staticStatusResponse(req *http.Request, status int) *http.Response {
+	header := make(http.Header)
+	body := []byte{}
+	if status != http.StatusOK && status != http.StatusNotModified {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(http.StatusText(status) + "\n")
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Request:       req,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
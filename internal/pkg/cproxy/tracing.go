@@ -0,0 +1,472 @@
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceParentHeader - w3c trace context header
+const TraceParentHeader = "Traceparent"
+
+// RequestContextSpan - request context key, span of the request
+const RequestContextSpan = "cproxy.span"
+
+// span kinds as defined by otlp
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span status codes as defined by otlp
+const (
+	spanStatusUnset = 0
+	spanStatusError = 2
+)
+
+// traceQueueSize - ended spans waiting for export, spans are dropped when full
+const traceQueueSize = 4096
+
+// Span - timed operation within a trace, methods are safe to call on a nil
+// span so callers need not check if tracing is enabled
+type Span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	mutex      sync.Mutex
+	attributes []spanAttribute
+	errMessage string
+	failed     bool
+	exporter   *traceExporter
+}
+
+// spanAttribute - key value pair recorded on span
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// traceExporter - sends ended spans to otlp/http endpoint in batches
+type traceExporter struct {
+	config *TracingConfig
+	client *http.Client
+	spans  chan *Span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// activeTracer - exporter spans are sent to, nil when tracing is disabled
+var activeTracer atomic.Value
+
+// StartTracing - start exporting spans to configured endpoint, returns
+// function that flushes queued spans and stops exporting
+func StartTracing(config *Config) func() {
+	if config.Tracing.Endpoint == "" {
+		return func() {}
+	}
+	tracingConfig := config.Tracing
+	t := &traceExporter{
+		config: &tracingConfig,
+		client: &http.Client{Timeout: time.Duration(tracingConfig.Timeout)},
+		spans:  make(chan *Span, traceQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	activeTracer.Store(t)
+	go t.run()
+	return func() {
+		activeTracer.Store((*traceExporter)(nil))
+		close(t.stop)
+		<-t.done
+	}
+}
+
+// getTracer - get active exporter, nil when tracing is disabled
+func getTracer() *traceExporter {
+	t, _ := activeTracer.Load().(*traceExporter)
+	return t
+}
+
+// StartRequestSpan - start server span for request, continues the trace of
+// an incoming traceparent header, returns nil when tracing is disabled
+func StartRequestSpan(req *http.Request) *Span {
+	t := getTracer()
+	rc := GetRequestContext(req)
+	if t == nil || rc == nil {
+		return nil
+	}
+	span := &Span{
+		name:     req.Method,
+		kind:     spanKindServer,
+		start:    time.Now(),
+		exporter: t,
+	}
+	if traceID, parentID, flags, ok := parseTraceParent(req.Header.Get(TraceParentHeader)); ok {
+		span.traceID = traceID
+		span.parentID = parentID
+		span.sampled = flags&1 == 1
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = mrand.Float64() < t.config.SampleRatio
+	}
+	rand.Read(span.spanID[:])
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.path", req.URL.Path)
+	span.SetAttribute("server.address", req.Host)
+	span.SetAttribute("client.address", req.RemoteAddr)
+	span.SetAttribute("user_agent.original", req.UserAgent())
+	span.SetAttribute("cproxy.request_id", rc.ID)
+	rc.Set(RequestContextSpan, span)
+	return span
+}
+
+// GetSpan - get span of request, nil when request is not traced
+func GetSpan(req *http.Request) *Span {
+	rc := GetRequestContext(req)
+	if rc == nil {
+		return nil
+	}
+	span, ok := rc.Get(RequestContextSpan)
+	if !ok {
+		return nil
+	}
+	return span.(*Span)
+}
+
+// StartSpan - start child span of request span, extensions may use it to
+// trace their own work, returns nil when request is not traced
+func StartSpan(req *http.Request, name string) *Span {
+	return startSpan(req, name, spanKindInternal)
+}
+
+// startSpan - start child span of given kind
+func startSpan(req *http.Request, name string, kind int) *Span {
+	parent := GetSpan(req)
+	if parent == nil {
+		return nil
+	}
+	span := &Span{
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		sampled:  parent.sampled,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		exporter: parent.exporter,
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// startExtensionSpan - start span for extension event
+func startExtensionSpan(req *http.Request, ext Extension, event string) *Span {
+	span := StartSpan(req, event+" "+ext.Name)
+	span.SetAttribute("cproxy.extension", ext.Name)
+	span.SetAttribute("cproxy.extension.event", event)
+	return span
+}
+
+// TraceID - hex encoded trace id
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SpanID - hex encoded span id
+func (s *Span) SpanID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.spanID[:])
+}
+
+// TraceParent - traceparent header value with span as parent
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceID() + "-" + s.SpanID() + "-" + flags
+}
+
+// SetAttribute - set span attribute, replaces value of existing key
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.attributes {
+		if s.attributes[i].key == key {
+			s.attributes[i].value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+}
+
+// SetError - mark span as failed, nil errors are ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failed = true
+	s.errMessage = err.Error()
+}
+
+// SetStatusCode - record http status code, server errors mark span as failed
+func (s *Span) SetStatusCode(statusCode int) {
+	if s == nil {
+		return
+	}
+	s.SetAttribute("http.response.status_code", statusCode)
+	if statusCode >= 500 {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.failed = true
+	}
+}
+
+// End - end span and queue it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mutex.Unlock()
+	if s.sampled && s.exporter != nil {
+		s.exporter.enqueue(s)
+	}
+}
+
+// parseTraceParent - parse w3c traceparent header value
+func parseTraceParent(value string) (traceID [16]byte, parentID [8]byte, flags byte, ok bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 || value != strings.ToLower(value) {
+		return traceID, parentID, 0, false
+	}
+	flagBytes, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, 0, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, 0, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, 0, false
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, 0, false
+	}
+	return traceID, parentID, flagBytes[0], true
+}
+
+// enqueue - queue ended span, dropped when queue is full
+func (t *traceExporter) enqueue(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		GetLogger().Debug("trace queue full, span dropped", "span", span.name)
+	}
+}
+
+// run - batch queued spans, exported when batch is full or at flush interval
+func (t *traceExporter) run() {
+	defer close(t.done)
+	interval := time.Duration(t.config.FlushInterval)
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, t.config.BatchSize)
+	for {
+		select {
+		case span := <-t.spans:
+			{
+				batch = append(batch, span)
+				if len(batch) >= t.config.BatchSize {
+					t.export(batch)
+					batch = batch[:0]
+				}
+				break
+			}
+		case <-ticker.C:
+			{
+				t.export(batch)
+				batch = batch[:0]
+				break
+			}
+		case <-t.stop:
+			{
+				// flush spans ended before stop
+				for len(t.spans) > 0 {
+					batch = append(batch, <-t.spans)
+				}
+				t.export(batch)
+				return
+			}
+		}
+	}
+}
+
+// export - send spans to endpoint as otlp/http json
+func (t *traceExporter) export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		GetLogger().Warn("trace export failed", "endpoint", t.config.Endpoint, "error", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		GetLogger().Warn("trace export failed", "endpoint", t.config.Endpoint, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		GetLogger().Warn("trace export failed", "endpoint", t.config.Endpoint, "error", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		GetLogger().Warn("trace export failed", "endpoint", t.config.Endpoint, "status", resp.StatusCode, "spans", len(spans))
+	}
+}
+
+// request - build otlp export request
+func (t *traceExporter) request(spans []*Span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, span.otlp())
+	}
+	return map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]spanAttribute{{key: "service.name", value: t.config.ServiceName}}),
+			},
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]interface{}{"name": strings.ToLower(AppName), "version": strconv.Itoa(VersionNo)},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
+
+// otlp - span in otlp json encoding
+func (s *Span) otlp() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := map[string]interface{}{"code": spanStatusUnset}
+	if s.failed {
+		status["code"] = spanStatusError
+		if s.errMessage != "" {
+			status["message"] = s.errMessage
+		}
+	}
+	otlpSpan := map[string]interface{}{
+		"traceId":           s.TraceID(),
+		"spanId":            s.SpanID(),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+		"status":            status,
+	}
+	if s.parentID != [8]byte{} {
+		otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	return otlpSpan
+}
+
+// otlpAttributes - attributes in otlp json encoding
+func otlpAttributes(attributes []spanAttribute) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attributes))
+	for _, attribute := range attributes {
+		var value map[string]interface{}
+		switch v := attribute.value.(type) {
+		case bool:
+			{
+				value = map[string]interface{}{"boolValue": v}
+				break
+			}
+		case int:
+			{
+				value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+				break
+			}
+		case int64:
+			{
+				value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+				break
+			}
+		case float64:
+			{
+				value = map[string]interface{}{"doubleValue": v}
+				break
+			}
+		default:
+			{
+				value = map[string]interface{}{"stringValue": fmt.Sprint(logValue(v))}
+				break
+			}
+		}
+		out = append(out, map[string]interface{}{"key": attribute.key, "value": value})
+	}
+	return out
+}
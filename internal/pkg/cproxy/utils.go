@@ -1,69 +1,150 @@
-/*
-This file is part of CProxy.
-
-CProxy is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-CProxy is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package cproxy
-
-import (
-	"bufio"
-	"bytes"
-	"log"
-	"net"
-	"net/http"
-)
-
-// GetListener - get listener for incomming requests
-func GetListener(config *Config) (net.Listener, error) {
-	// attempt tcp listener
-	listener, err := net.Listen("tcp", config.Listen)
-	if err != nil {
-		// attempt unix listener
-		listener, err = net.Listen("unix", config.Listen)
-	}
-	return listener, err
-}
-
-// error500HTML - HTML for error 500 page
-const error500HTML = `<!DOCTYPE html><html><head><title>Error 500</title><meta charset="UTF-8"/><style type="text/css"> html, body{font-family: sans-serif; text-align: center; margin-top: 40px;}h1{color: #000; font-size: 36px;}</style></head><body><h1>Error 500</h1></body></html>`
-
-// RenderErrorPage - render an error page
-func RenderErrorPage(w http.ResponseWriter, r *http.Request, err error) {
-	log.Println("ERROR ::", err.Error())
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(500)
-	w.Write([]byte(error500HTML))
-}
-
-// HTTPResponseToBytes - convert http response to bytes
-func HTTPResponseToBytes(r *http.Response) ([]byte, error) {
-	buf := bytes.NewBuffer(nil)
-	bufW := bufio.NewWriter(buf)
-	err := r.Write(bufW)
-	if err != nil {
-		return nil, err
-	}
-	bufW.Flush()
-	r.Body.Close()
-	return buf.Bytes(), nil
-}
-
-// HTTPResponseFromBytes - convert bytes to http response
-func HTTPResponseFromBytes(b []byte) (*http.Response, error) {
-	return http.ReadResponse(
-		bufio.NewReader(bytes.NewReader(b)),
-		nil,
-	)
-}
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// GetListener - get listener for incomming requests
+func GetListener(config *Config) (net.Listener, error) {
+	return listen(config.Listen)
+}
+
+// GetAdminListener - get listener for admin requests, a tcp listener is
+// refused without an admin token since only a unix socket may go unprotected
+func GetAdminListener(config *Config) (net.Listener, error) {
+	listener, err := listen(config.Admin.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := listener.Addr().(*net.UnixAddr); !ok && config.Admin.Token == "" {
+		listener.Close()
+		return nil, errors.New("admin listener on tcp address requires admin token")
+	}
+	return listener, nil
+}
+
+// listen - listen on tcp address or unix socket
+func listen(address string) (net.Listener, error) {
+	// attempt tcp listener
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		// attempt unix listener
+		listener, err = net.Listen("unix", address)
+	}
+	return listener, err
+}
+
+// CloseListener - close listener, unix listeners also remove their socket file
+func CloseListener(listener net.Listener) error {
+	err := listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	if addr, ok := listener.Addr().(*net.UnixAddr); ok {
+		if rmErr := os.Remove(addr.Name); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// HTTPResponseToBytes - convert http response to bytes
+func HTTPResponseToBytes(r *http.Response) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	bufW := bufio.NewWriter(buf)
+	err := r.Write(bufW)
+	if err != nil {
+		return nil, err
+	}
+	bufW.Flush()
+	r.Body.Close()
+	return buf.Bytes(), nil
+}
+
+// HTTPResponseFromBytes - convert bytes to http response
+func HTTPResponseFromBytes(b []byte) (*http.Response, error) {
+	return http.ReadResponse(
+		bufio.NewReader(bytes.NewReader(b)),
+		nil,
+	)
+}
+
+// BufferResponse - read entire response in to memory so the
+// backend connection can be closed
+func BufferResponse(resp *http.Response, req *http.Request) (*http.Response, error) {
+	buf := bytes.NewBuffer(nil)
+	bufW := bufio.NewWriter(buf)
+	err := resp.Write(bufW)
+	// close the original response
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	bufW.Flush()
+	return http.ReadResponse(
+		bufio.NewReader(bytes.NewReader(buf.Bytes())),
+		req,
+	)
+}
+
+// closeFuncBody - response body that calls closeFunc once when closed
+type closeFuncBody struct {
+	io.ReadCloser
+	closeFunc func()
+	once      sync.Once
+}
+
+// Close - close body and call close func
+func (b *closeFuncBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.closeFunc)
+	return err
+}
+
+// CopyResponseBody - copy response body to response writer, when flush
+// is set the writer is flushed after every write so the client receives
+// data as it arrives
+func CopyResponseBody(w http.ResponseWriter, body io.Reader, flush bool) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	if !flush || !ok {
+		return io.Copy(w, body)
+	}
+	return io.Copy(&flushWriter{w: w, flusher: flusher}, body)
+}
+
+// flushWriter - writer that flushes after every write
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// Write - write and flush
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.flusher.Flush()
+	return n, err
+}
@@ -1,156 +1,336 @@
-/*
-This file is part of CProxy.
-
-CProxy is free software: you can redistribute it and/or modify
-it under the terms of the GNU General Public License as published by
-the Free Software Foundation, either version 3 of the License, or
-(at your option) any later version.
-
-CProxy is distributed in the hope that it will be useful,
-but WITHOUT ANY WARRANTY; without even the implied warranty of
-MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
-GNU General Public License for more details.
-
-You should have received a copy of the GNU General Public License
-along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
-*/
-
-package main
-
-import (
-	"flag"
-	"io"
-	"log"
-	"net/http"
-	"net/http/fcgi"
-	"os"
-	"path/filepath"
-	"strings"
-
-	"./internal/pkg/cproxy"
-)
-
-func main() {
-
-	// display app name + version
-	log.Printf("%s v%.2f", cproxy.AppName, cproxy.VersionNo/100.0)
-
-	// command line args
-	execPath, err := os.Executable()
-	if err != nil {
-		execPath = "."
-	}
-	configFilePath := flag.String(
-		"config-path",
-		filepath.Join(filepath.Dir(execPath), cproxy.DefaultConfigFilePath),
-		"Path to configuration file.",
-	)
-	enableExts := flag.String(
-		"extensions",
-		"",
-		"Comma delimited list of extensions to enable.",
-	)
-	proxyType := flag.String(
-		"proxy-type",
-		"",
-		"Type of proxy to employ. (http or fcgi)",
-	)
-	listen := flag.String(
-		"listen",
-		"",
-		"Port or socket to listen on. (socket path, port)",
-	)
-	backend := flag.String(
-		"backend",
-		"",
-		"Backend to connect to. (host:port, socket path, url)",
-	)
-	flag.Parse()
-	// load config
-	config := cproxy.LoadConfigFile(*configFilePath)
-	if *enableExts != "" {
-		config.Extensions.Enabled = strings.Split(*enableExts, ",")
-	}
-	if *proxyType != "" {
-		config.ProxyType = *proxyType
-	}
-	if *listen != "" {
-		config.Listen = *listen
-	}
-	if *backend != "" {
-		config.Backend = *backend
-	}
-	// load extensions
-	var exts []cproxy.Extension
-	exts, err = cproxy.LoadExtensions(
-		&config,
-		func(req *http.Request) (*http.Response, error) {
-			req.Header.Set("X-Sub-Request", "1")
-			return cproxy.HandleRequest(req, &config, &exts)
-		},
-	)
-	if err != nil {
-		panic(err)
-	}
-
-	// create listener
-	listener, err := cproxy.GetListener(&config)
-	if err != nil {
-		panic(err)
-	}
-	defer listener.Close()
-
-	// handle incoming request
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// handle request
-		resp, err := cproxy.HandleRequest(
-			r,
-			&config,
-			&exts,
-		)
-		if err != nil {
-			panic(err)
-		}
-		// set response headers
-		for k, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(k, value)
-			}
-		}
-		w.Header().Add("X-Proxy-Name", cproxy.AppName)
-		// write status code
-		w.WriteHeader(resp.StatusCode)
-		// set response body
-		_, err = io.Copy(w, resp.Body)
-		if err != nil {
-			cproxy.RenderErrorPage(w, r, err)
-		}
-
-	})
-
-	// determine proxy type and begin listening on configured port
-	switch config.ProxyType {
-	case cproxy.ProxyTypeFCGI:
-		{
-			// listen for cgi requests
-			log.Println("INIT :: Listen for FastCGI requests on", config.Listen+".")
-			err := fcgi.Serve(listener, handler)
-			if err != nil {
-				panic(err)
-			}
-			break
-		}
-	case cproxy.ProxyTypeHTTP:
-		{
-			// listen for http requests
-			log.Println("INIT :: Listen for HTTP requests on", config.Listen+".")
-			err := http.Serve(listener, handler)
-			if err != nil {
-				panic(err)
-			}
-			break
-		}
-	}
-
-}
+/*
+This file is part of CProxy.
+
+CProxy is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+CProxy is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with CProxy.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"cproxy/internal/pkg/cproxy"
+)
+
+// applyConfigFlags - apply command line args on top of config, a backend
+// given on the command line replaces the configured backend list
+func applyConfigFlags(config *cproxy.Config, enableExts string, proxyType string, listen string, backend string) {
+	if enableExts != "" {
+		config.Extensions.Enabled = strings.Split(enableExts, ",")
+	}
+	if proxyType != "" {
+		config.ProxyType = proxyType
+	}
+	if listen != "" {
+		config.Listen = listen
+	}
+	if backend != "" {
+		config.Backend = backend
+		config.Backends = nil
+	}
+}
+
+func main() {
+
+	// display app name + version
+	cproxy.GetLogger().Info(fmt.Sprintf("%s v%.2f", cproxy.AppName, cproxy.VersionNo/100.0))
+
+	// command line args
+	execPath, err := os.Executable()
+	if err != nil {
+		execPath = "."
+	}
+	configFilePath := flag.String(
+		"config-path",
+		filepath.Join(filepath.Dir(execPath), cproxy.DefaultConfigFilePath),
+		"Path to configuration file.",
+	)
+	enableExts := flag.String(
+		"extensions",
+		"",
+		"Comma delimited list of extensions to enable.",
+	)
+	proxyType := flag.String(
+		"proxy-type",
+		"",
+		"Type of proxy to employ. (http or fcgi)",
+	)
+	listen := flag.String(
+		"listen",
+		"",
+		"Port or socket to listen on. (socket path, port)",
+	)
+	backend := flag.String(
+		"backend",
+		"",
+		"Backend to connect to. (host:port, socket path, url)",
+	)
+	checkConfig := flag.Bool(
+		"check-config",
+		false,
+		"Validate configuration and exit, non-zero exit status when not valid.",
+	)
+	printConfig := flag.Bool(
+		"print-config",
+		false,
+		"Print effective configuration after merging config files and command line args, with secrets redacted, and exit.",
+	)
+	printConfigUnredacted := flag.Bool(
+		"print-config-unredacted",
+		false,
+		"Print effective configuration including secrets and exit.",
+	)
+	flag.Parse()
+	configPathSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config-path" {
+			configPathSet = true
+		}
+	})
+	// command line args take priority over config file, also on reload
+	applyFlags := func(config *cproxy.Config) {
+		applyConfigFlags(config, *enableExts, *proxyType, *listen, *backend)
+	}
+	// load and validate config, the config file may only be missing when
+	// no path was given
+	config, err := cproxy.LoadConfigFile(*configFilePath)
+	if errors.Is(err, os.ErrNotExist) && !configPathSet {
+		cproxy.GetLogger().Warn("config file not found, using defaults", "path", *configFilePath)
+		config, err = cproxy.GetDefaultConfig(), nil
+	}
+	if err == nil {
+		applyFlags(&config)
+		err = cproxy.ValidateConfig(&config)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *printConfig || *printConfigUnredacted {
+		var printed interface{} = config
+		if !*printConfigUnredacted {
+			if printed, err = cproxy.GetRedactedConfig(&config); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		configBytes, err := json.MarshalIndent(printed, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(configBytes))
+		return
+	}
+	if *checkConfig {
+		fmt.Println("config ok")
+		return
+	}
+	// configure logging
+	logger, err := cproxy.NewLogger(&config.Log)
+	if err != nil {
+		panic(err)
+	}
+	cproxy.SetLogger(logger)
+	// load extensions, open access log and start active backend health checks
+	runtime, err := cproxy.NewRuntime(config, func() (cproxy.Config, error) {
+		config, err := cproxy.LoadConfigFile(*configFilePath)
+		if err != nil {
+			return config, err
+		}
+		applyFlags(&config)
+		return config, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// create listener, connections are tracked so shutdown also waits for
+	// requests that were accepted but have not reached the handler
+	netListener, err := cproxy.GetListener(&config)
+	if err != nil {
+		panic(err)
+	}
+	listener := cproxy.TrackListener(netListener)
+
+	// start exporting trace spans
+	stopTracing := cproxy.StartTracing(&config)
+
+	// start admin listener
+	var adminListener net.Listener
+	var adminServer *http.Server
+	if config.Admin.Listen != "" {
+		adminListener, err = cproxy.GetAdminListener(&config)
+		if err != nil {
+			panic(err)
+		}
+		cproxy.GetLogger().Info("listen for admin requests", "listen", config.Admin.Listen)
+		adminServer = &http.Server{Handler: cproxy.NewAdminHandler(runtime)}
+		go func() {
+			if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				cproxy.GetLogger().Error("admin listener failed", "error", err)
+			}
+		}()
+	}
+
+	// handle incoming request
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// track in-flight request, handled with the config and extensions
+		// current when it arrived
+		cproxy.RequestStarted()
+		instance := runtime.Acquire()
+		defer instance.Release()
+
+		// attach request context
+		r, rc := cproxy.NewRequestContext(r)
+		rc.Instance = instance
+		rw := cproxy.NewResponseWriter(w)
+		rw.Header().Set(cproxy.RequestIDHeader, rc.ID)
+		span := cproxy.StartRequestSpan(r)
+		defer func() {
+			span.SetStatusCode(rw.Status())
+			span.End()
+			cproxy.RequestFinished(r, rw.Status(), rc.Duration())
+			if instance.AccessLog != nil {
+				instance.AccessLog.Log(r, rw)
+			}
+		}()
+
+		// select virtual host and route then handle request
+		siteConfig, exts, err := instance.Match(r)
+		if err != nil {
+			cproxy.RenderErrorPage(rw, r, instance.Config, err)
+			return
+		}
+		resp, err := cproxy.HandleRequest(r, siteConfig, exts)
+		if err != nil {
+			cproxy.RenderErrorPage(rw, r, siteConfig, err)
+			return
+		}
+		defer resp.Body.Close()
+		// set response headers
+		for k, values := range resp.Header {
+			for _, value := range values {
+				rw.Header().Add(k, value)
+			}
+		}
+		rw.Header().Add("X-Proxy-Name", cproxy.AppName)
+		// write status code
+		rw.WriteHeader(resp.StatusCode)
+		// set response body
+		_, err = cproxy.CopyResponseBody(rw, resp.Body, siteConfig.StreamResponse)
+		if err != nil {
+			// headers already sent, nothing more can be done for the client
+			cproxy.RequestLogger(r).Warn("response body copy failed", "error", err)
+		}
+
+	})
+
+	// determine proxy type and begin listening on configured port
+	var server *http.Server
+	serveErr := make(chan error, 1)
+	switch config.ProxyType {
+	case cproxy.ProxyTypeFCGI:
+		{
+			// listen for cgi requests
+			cproxy.GetLogger().Info("listen for FastCGI requests", "listen", config.Listen)
+			go func() {
+				serveErr <- fcgi.Serve(listener, handler)
+			}()
+			break
+		}
+	case cproxy.ProxyTypeHTTP:
+		{
+			// listen for http requests
+			cproxy.GetLogger().Info("listen for HTTP requests", "listen", config.Listen)
+			server = &http.Server{Handler: handler}
+			go func() {
+				serveErr <- server.Serve(listener)
+			}()
+			break
+		}
+	}
+
+	// reload config and reopen access log on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			cproxy.GetLogger().Info("reload signal received")
+			if err := runtime.Reload(); err != nil {
+				cproxy.GetLogger().Error("config reload failed", "error", err)
+			}
+			// access log is rebuilt by reload when its config changed,
+			// otherwise the file is reopened after rotation
+			if accessLog := runtime.Current().AccessLog; accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					cproxy.GetLogger().Warn("access log reopen failed", "error", err)
+				}
+			}
+		}
+	}()
+
+	// wait for shutdown signal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		{
+			cproxy.GetLogger().Info("shutdown signal received", "signal", sig.String())
+			break
+		}
+	case err := <-serveErr:
+		{
+			panic(err)
+		}
+	}
+
+	// stop accepting connections and drain in-flight requests
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(runtime.Current().Config.ShutdownTimeout),
+	)
+	defer cancel()
+	if err := cproxy.Shutdown(ctx, server, listener); err != nil {
+		cproxy.GetLogger().Warn("requests still in-flight after shutdown timeout", "in_flight", cproxy.InFlightRequests())
+	}
+
+	// stop admin listener and tracing
+	if adminServer != nil {
+		adminServer.Close()
+		if err := cproxy.CloseListener(adminListener); err != nil {
+			cproxy.GetLogger().Warn("shutdown", "error", err)
+		}
+	}
+	stopTracing()
+
+	// stop health checks, close access log and unload extensions
+	runtime.Close()
+	cproxy.GetLogger().Info("shutdown complete")
+
+}